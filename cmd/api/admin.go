@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Reads the user ID from the URL and fetches the matching user, sending the appropriate
+// error response and returning nil if that fails
+func (app *application) readUserFromIDParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return nil
+	}
+
+	return user
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string
+		Activated   *bool
+		CreatedFrom *time.Time
+		CreatedTo   *time.Time
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Activated = app.readBool(qs, "activated", nil, v)
+	input.CreatedFrom = app.readTime(qs, "created_from", nil, v)
+	input.CreatedTo = app.readTime(qs, "created_to", nil, v)
+
+	// The created_to bound is exclusive, so a plain date is moved to the start of the next
+	// day, to include users created at any time on that date
+	if _, err := time.Parse(time.DateOnly, qs.Get("created_to")); err == nil && input.CreatedTo != nil {
+		end := input.CreatedTo.AddDate(0, 0, 1)
+		input.CreatedTo = &end
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if input.CreatedFrom != nil && input.CreatedTo != nil {
+		v.Check(input.CreatedFrom.Before(*input.CreatedTo), "created_to", "must be later than created_from")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Email, input.Activated, input.CreatedFrom, input.CreatedTo, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Activates or deactivates a user, depending on the "activated" value in the request body
+func (app *application) updateUserActivatedHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.CheckCode(input.Activated != nil, "activated", validator.CodeRequired, "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user.Activated = *input.Activated
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Check the requested codes against the permissions known to the database, so that
+	// a typo is reported rather than silently ignored
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.CheckCode(len(input.Permissions) >= 1, "permissions", validator.CodeTooFew, "must contain at least 1 permission")
+	for _, code := range input.Permissions {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Forces a password reset: the current password is replaced with an unguessable random
+// one, every token the user holds is revoked, and a password reset token is emailed to them
+func (app *application) forceUserPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := user.Password.Set(rand.Text())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	passwordResetTTL := 45 * time.Minute
+
+	token, err := app.models.Tokens.New(user.ID, passwordResetTTL, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.enqueueEmail(user, "token_password_reset.tmpl", map[string]any{
+		"passwordResetTTL": passwordResetTTL.String(),
+	}, map[string]any{
+		"passwordResetToken": token.Plaintext,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "the user's password has been reset and an email will be sent to them containing password reset instructions"}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "all tokens for the user have been revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lifts any lockout on a user's account and clears their failed login counters, for both
+// passwords and second factor codes
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.Logins.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.MFAAttempts.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "the user's account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lists the emails queued for a user and whether each was delivered, so support can check
+// that (for example) an activation email actually went out
+func (app *application) listUserEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserFromIDParam(w, r)
+	if user == nil {
+		return
+	}
+
+	emails, err := app.models.Outbox.GetAllForRecipient(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"emails": emails}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/lib/pq"
+)
+
+// eventBroker LISTENs for the notifications sent when change feed events are committed
+// (by any instance of the application) and wakes up the requests which are waiting for
+// new events. Subscribers are only told that there might be new events, and read them
+// from the events table themselves, so a missed or coalesced wake-up loses nothing. The
+// broker also relays movie cache invalidations from the other instances
+type eventBroker struct {
+	listener *pq.Listener
+	logger   *slog.Logger
+	movies   data.MovieModel
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+
+	// Pings run alongside run(), which waits for them before returning
+	pings sync.WaitGroup
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newEventBroker(dsn string, logger *slog.Logger, movies data.MovieModel) (*eventBroker, error) {
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("event listener problem", "error", err.Error())
+		}
+	}
+
+	b := &eventBroker{
+		listener:    pq.NewListener(dsn, 10*time.Second, time.Minute, reportProblem),
+		logger:      logger,
+		movies:      movies,
+		subscribers: map[chan struct{}]struct{}{},
+		done:        make(chan struct{}),
+	}
+
+	for _, channel := range []string{data.EventsChannel, data.MovieCacheChannel} {
+		err := b.listener.Listen(channel)
+		if err != nil {
+			b.listener.Close()
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// run() relays notifications to the subscribers until the broker is closed
+func (b *eventBroker) run() {
+	defer b.pings.Wait()
+
+	for {
+		select {
+		case <-b.done:
+			return
+
+		// A nil notification is sent after the listener reconnects, when notifications
+		// may have been missed, so subscribers are woken up and the cache is emptied
+		case n := <-b.listener.Notify:
+			switch {
+			case n == nil:
+				b.movies.InvalidateAll()
+				b.broadcast()
+
+			case n.Channel == data.MovieCacheChannel:
+				id, err := strconv.ParseInt(n.Extra, 10, 64)
+				if err != nil {
+					b.movies.InvalidateAll()
+					continue
+				}
+
+				b.movies.Invalidate(id)
+
+			default:
+				b.broadcast()
+			}
+
+		// Check that the connection is still alive if it has been quiet for a while. The
+		// ping waits for a reply, which the listener can't deliver while its notification
+		// channel is full, so it mustn't block the loop which empties that channel
+		case <-time.After(90 * time.Second):
+			b.pings.Go(b.ping)
+		}
+	}
+}
+
+func (b *eventBroker) ping() {
+	err := b.listener.Ping()
+	if err != nil {
+		b.logger.Error("unable to ping event listener", "error", err.Error())
+	}
+}
+
+func (b *eventBroker) broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		// Each channel has room for one pending wake-up, which is all a subscriber needs
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe() returns a channel which receives a value whenever there may be new events,
+// and a function to call when the subscriber is finished with it
+func (b *eventBroker) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+
+	return ch, unsubscribe
+}
+
+// Done() returns a channel which is closed when the broker shuts down. Long-lived requests
+// should return as soon as it is closed, so that they don't hold up the server's shutdown
+func (b *eventBroker) Done() <-chan struct{} {
+	return b.done
+}
+
+// Close() stops the broker and closes its database connection
+func (b *eventBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		err := b.listener.Close()
+		if err != nil {
+			b.logger.Error("unable to close event listener", "error", err.Error())
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/azizjon12/greenlight/internal/data"
+)
+
+// Define a custom contextKey type, with the underlying type string
+type contextKey string
+
+// Convert the string "user" to a contextKey type and assign it to the userContextKey
+// constant. We'll use this constant as the key for getting and setting user information
+// in the request context
+const userContextKey = contextKey("user")
+
+// Key for the API key used to authenticate the request, if any
+const apiKeyContextKey = contextKey("apiKey")
+
+// The contextSetUser() method returns a new copy of the request with the provided
+// User struct added to the context
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// The contextGetUser() retrieves the User struct from the request context. The only
+// time that we'll use this helper is when we logically expect there to be User struct
+// value in the context, and if it doesn't exist it will firmly be an 'unexpected' error
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key used
+// to authenticate it added to the context
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() retrieves the API key from the request context. Unlike the user,
+// it is normal for there to be no API key, in which case nil is returned
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// Key for the ID assigned to the request by the requestID() middleware
+const requestIDContextKey = contextKey("requestID")
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() retrieves the request ID from the request context, or returns
+// "" if there isn't one
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/mailer"
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Returns sample values for all of the data the email templates use, so that any of them
+// can be previewed without a real user or token
+func sampleEmailData() map[string]any {
+	return map[string]any{
+		"name":               "Alice Smith",
+		"userID":             123,
+		"activationToken":    "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationTTL":      (3 * 24 * time.Hour).String(),
+		"passwordResetToken": "P4B3URJZJ2NW5UPZC2OHN4H2NM",
+		"passwordResetTTL":   (45 * time.Minute).String(),
+		"lockedUntil":        time.Now().Add(15 * time.Minute),
+	}
+}
+
+// Lists the email templates and the locales each has been translated into
+func (app *application) listEmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := app.mailer.Templates()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"templates": templates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Renders an email template with sample data. By default the subject, plain text and HTML
+// parts are returned as JSON, but with ?format=html the HTML part is returned on its own,
+// so it can be viewed directly in a browser
+func (app *application) previewEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	locale := app.readString(qs, "locale", mailer.DefaultLocale)
+	format := app.readString(qs, "format", "json")
+
+	data.ValidateLocale(v, locale)
+	v.Check(validator.PermittedValue(format, "json", "html"), "format", "must be json or html")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	msg, err := app.mailer.Render(locale, name, sampleEmailData())
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrUnknownTemplate):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// The HTML is served from the API's own origin, so it is locked down as far as it can
+	// be: the browser mustn't sniff it as anything else, run scripts in it or load anything
+	// except inline styles and embedded images
+	if format == "html" {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; base-uri 'none'; form-action 'none'; frame-ancestors 'none'; sandbox")
+		w.WriteHeader(http.StatusOK)
+
+		// The headers have been sent, so a failed write can only be logged
+		_, err = w.Write([]byte(msg.HTMLBody))
+		if err != nil {
+			app.logger.Error("unable to write email preview", "template", name, "error", err.Error())
+		}
+
+		return
+	}
+
+	env := envelope{
+		"subject":    msg.Subject,
+		"plain_body": msg.PlainBody,
+		"html_body":  msg.HTMLBody,
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Renders an email template with sample data and sends it to the given address through
+// the configured mail transport. The email is sent straight away rather than queued, so
+// that any delivery error is reported in the response
+func (app *application) sendTestEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email  string `json:"email"`
+		Locale string `json:"locale"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Locale == "" {
+		input.Locale = mailer.DefaultLocale
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateLocale(v, input.Locale)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	err = app.mailer.Send(input.Email, input.Locale, name, sampleEmailData())
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrUnknownTemplate):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "the test email has been sent"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/azizjon12/greenlight/internal/mailer"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestPreviewEmailTemplateHTML(t *testing.T) {
+	m, err := mailer.New(mailer.NewMemoryTransport(), "Greenlight <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		mailer: m,
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/email-templates/user_welcome.tmpl?format=html", nil)
+	params := httprouter.Params{{Key: "name", Value: "user_welcome.tmpl"}}
+	r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+	w := httptest.NewRecorder()
+
+	app.previewEmailTemplateHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+	}
+
+	headers := map[string]string{
+		"Content-Type":           "text/html; charset=utf-8",
+		"X-Content-Type-Options": "nosniff",
+		"Vary":                   "Accept",
+	}
+
+	for key, want := range headers {
+		if got := w.Header().Get(key); got != want {
+			t.Errorf("got %s %q; want %q", key, got, want)
+		}
+	}
+
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "sandbox") {
+		t.Errorf("got Content-Security-Policy %q; want it to block scripts and other content", csp)
+	}
+
+	if !strings.Contains(w.Body.String(), "Alice Smith") {
+		t.Errorf("body is not the rendered template:\n%s", w.Body)
+	}
+}
@@ -1,74 +1,250 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/validator"
 )
 
 // logError() method is a helper for logging an error message, along
-// with the current request method and URL as attributes in the log entry
+// with the current request method, URL and ID as attributes in the log entry
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		requestID = app.contextGetRequestID(r)
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
+}
+
+// problem is an RFC 9457 problem details object, with the ID of the failed request and,
+// for validation failures, the errors for each field
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
 }
 
-// Used for sending JSON-formatted error messages to the client with a given status code.
-// We use "any" type for the message parameter, as this gives us more flexibility over the values that we can include in the response
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Used for sending error messages to the client with a given status code. By default the
+// message is sent as {"error": message}, or {"error": v.Errors} if there are field errors.
+// Clients which accept application/problem+json are sent a problem details object instead,
+// of the type given by problemType
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, problemType, message string, v *validator.Validator) {
+	// Error responses are never cached, whatever the policy of the route
+	w.Header().Set("Cache-Control", cacheNoStore)
+
+	var err error
+
+	if acceptsProblem(r.Header.Values("Accept")) {
+		p := problem{
+			Type:      app.problemTypeURI(problemType),
+			Title:     http.StatusText(status),
+			Status:    status,
+			Detail:    message,
+			Instance:  r.URL.Path,
+			RequestID: app.contextGetRequestID(r),
+			Errors:    fieldErrorList(v),
+		}
 
-	// Write the response using the writeJSON() helper. If  this happens
-	// to return an error then log it, and fallback to sending the client an empty
-	// response with a 500 Internal Server Error status code
-	err := app.writeJSON(w, status, env, nil)
+		err = app.writeProblem(w, r, p)
+	} else {
+		env := envelope{"error": message}
+		if v != nil {
+			env = envelope{"error": v.Errors}
+		}
+
+		// Write the response using the writeResponse() helper
+		err = app.writeResponse(w, r, status, env, nil)
+	}
+
+	// If writing the response returns an error then log it, and fallback to sending the
+	// client an empty response with a 500 Internal Server Error status code
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+// writeProblem() sends p as application/problem+json. Problem details are always JSON, since
+// the client has asked for them by that media type
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, p problem) error {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	if app.prettyOutput(r) {
+		enc.SetIndent("", "\t")
+	}
+
+	err := enc.Encode(p)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	buf.WriteTo(w)
+
+	return nil
+}
+
+// problemTypeURI() returns the URI identifying a problem type, which is the slug each helper
+// below passes to errorResponse() under the -problem-type-base URL. Without a base URL every
+// problem has the type about:blank, which RFC 9457 defines as meaning nothing more than the
+// HTTP status code
+func (app *application) problemTypeURI(slug string) string {
+	if app.config.problemTypeBase == "" {
+		return "about:blank"
+	}
+
+	return app.config.problemTypeBase + slug
+}
+
+// fieldErrorList() converts the errors from a Validator into a list ordered by field, with
+// the machine-readable code recorded for each message
+func fieldErrorList(v *validator.Validator) []fieldError {
+	if v == nil {
+		return nil
+	}
+
+	list := make([]fieldError, 0, len(v.Errors))
+	for field, message := range v.Errors {
+		code := v.Codes[field]
+		if code == "" {
+			code = validator.CodeInvalid
+		}
+
+		list = append(list, fieldError{Field: field, Code: code, Message: message})
+	}
+
+	slices.SortFunc(list, func(a, b fieldError) int {
+		return strings.Compare(a.Field, b.Field)
+	})
+
+	return list
+}
+
 // Used when our application encounters an unexpected problem at runtime. It logs the detailed error message,
-// then uses the errorResponse() helper to send a 500 Internal Server Error code and JSON response messsage
+// then uses the errorResponse() helper to send a 500 Internal Server Error code and response messsage.
+// Constraint violations from the data models are the client's problem rather than ours, so
+// they are passed on to constraintViolationResponse() instead
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var constraintErr *data.ConstraintError
+	if errors.As(err, &constraintErr) {
+		app.constraintViolationResponse(w, r, constraintErr)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, "server-error", message, nil)
 }
 
-// Used to send a 404 Not Found code and JSON response
+// Used to send a 404 Not Found code and response
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not-found", message, nil)
 }
 
-// Used to send a 405 Method Not Allowed code and JSON response
+// Used to send a 405 Method Not Allowed code and response
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method-not-allowed", message, nil)
 }
 
-// Used to send a 400 Bad Request code and JSON response
+// Used to send a 400 Bad Request code and response
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad-request", err.Error(), nil)
 }
 
-// Note that errors paramter has the type map[string]string, which is the same
-// as the errors map contained in our Validator type
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// Used to send a 415 Unsupported Media Type code and response when the request body
+// is compressed with a coding we can't decode
+func (app *application) unsupportedContentEncodingResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request body must be sent uncompressed or with Content-Encoding: gzip"
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, "unsupported-content-encoding", message, nil)
+}
+
+// Note that the Validator is passed rather than just its errors map, so that the code
+// for each error can be included in problem details responses
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	message := "one or more fields are invalid"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "validation-failed", message, v)
+}
+
+// Used when a write violates a database constraint. If the constraint maps onto an input
+// field we report it like any other validation failure, otherwise we send a 409 Conflict
+func (app *application) constraintViolationResponse(w http.ResponseWriter, r *http.Request, err *data.ConstraintError) {
+	if err.Field != "" {
+		v := validator.New()
+		v.AddErrorCode(err.Field, err.Code, err.Message)
+
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	message := "unable to save the record because it conflicts with existing data"
+	app.errorResponse(w, r, http.StatusConflict, "constraint-violation", message, nil)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit-conflict", message, nil)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate-limit-exceeded", message, nil)
+}
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid-credentials", message, nil)
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	// Include a WWW-Authenticate: Bearer header to remind the client that we expect
+	// them to authenticate using a bearer token
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid-authentication-token", message, nil)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication-required", message, nil)
+}
+
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, "inactive-account", message, nil)
+}
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "API keys can't be used to manage your account, please authenticate with a token instead"
+	app.errorResponse(w, r, http.StatusForbidden, "api-key-not-allowed", message, nil)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, "not-permitted", message, nil)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+func TestFailedValidationProblem(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeBase string
+		wantType string
+	}{
+		{"with base", "https://example.com/problems/", "https://example.com/problems/validation-failed"},
+		{"without base", "", "about:blank"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.problemTypeBase = tt.typeBase
+
+			v := validator.New()
+			v.CheckCode(false, "title", validator.CodeRequired, "must be provided")
+			v.CheckCode(false, "genres", validator.CodeTooMany, "must not contain more than 5 genres")
+			v.Check(false, "year", "must not be in the future")
+
+			// Only the first error for a key is kept, along with its code
+			v.CheckCode(false, "title", validator.CodeTooLong, "must not be more than 500 bytes long")
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+			r.Header.Set("Accept", "application/problem+json")
+			w := httptest.NewRecorder()
+
+			app.failedValidationResponse(w, r, v)
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", w.Code, http.StatusUnprocessableEntity)
+			}
+
+			var p problem
+
+			err := json.Unmarshal(w.Body.Bytes(), &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.Type != tt.wantType {
+				t.Errorf("got type %q; want %q", p.Type, tt.wantType)
+			}
+
+			if p.Title != "Unprocessable Entity" {
+				t.Errorf("got title %q; want %q", p.Title, "Unprocessable Entity")
+			}
+
+			want := []fieldError{
+				{Field: "genres", Code: "too_many", Message: "must not contain more than 5 genres"},
+				{Field: "title", Code: "required", Message: "must be provided"},
+				{Field: "year", Code: "invalid", Message: "must not be in the future"},
+			}
+
+			if !reflect.DeepEqual(p.Errors, want) {
+				t.Errorf("got errors %+v; want %+v", p.Errors, want)
+			}
+		})
+	}
+}
+
+func TestFailedValidationEnvelope(t *testing.T) {
+	app := &application{}
+
+	v := validator.New()
+	v.CheckCode(false, "title", validator.CodeRequired, "must be provided")
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+	w := httptest.NewRecorder()
+
+	app.failedValidationResponse(w, r, v)
+
+	var body struct {
+		Error map[string]string `json:"error"`
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{"title": "must be provided"}; !reflect.DeepEqual(body.Error, want) {
+		t.Errorf("got error %v; want %v", body.Error, want)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+// How often a waiting request checks for new events if it isn't woken up by a notification
+// first. Notifications normally arrive straight away, so this is only a safety net
+const eventsPollInterval = 5 * time.Second
+
+// How often an idle event stream sends a comment line, so that proxies don't close it
+const streamHeartbeatInterval = 15 * time.Second
+
+// Returns the change feed events after the given ID, oldest first. If there aren't any
+// yet, the request is held open (long polling) for up to ?wait seconds until some arrive.
+// Clients follow the feed by passing the returned "next" value as ?after in their next
+// request
+func (app *application) listEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		After int
+		Limit int
+		Wait  int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.After = app.readInt(qs, "after", 0, v)
+	input.Limit = app.readInt(qs, "limit", 100, v)
+	input.Wait = app.readInt(qs, "wait", 25, v)
+
+	v.CheckCode(input.After >= 0, "after", validator.CodeTooSmall, "must be zero or more")
+	v.CheckCode(input.Limit > 0, "limit", validator.CodeTooSmall, "must be greater than zero")
+	v.CheckCode(input.Limit <= 1000, "limit", validator.CodeTooLarge, "must be a maximum of 1000")
+	v.CheckCode(input.Wait >= 0, "wait", validator.CodeTooSmall, "must be zero or more")
+	v.CheckCode(input.Wait <= 30, "wait", validator.CodeTooLarge, "must be a maximum of 30")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// The wait can outlast the server's write timeout, so extend it for this request
+	deadline := time.Now().Add(time.Duration(input.Wait) * time.Second)
+	http.NewResponseController(w).SetWriteDeadline(deadline.Add(10 * time.Second))
+
+	// Subscribe before the first read, so that no notification can slip in between
+	wake, unsubscribe := app.events.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	for {
+		events, err := app.models.Events.GetAfter(r.Context(), int64(input.After), input.Limit)
+		if err != nil {
+			// The client has gone away, so there's nobody to respond to
+			if r.Context().Err() != nil {
+				return
+			}
+
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			next := int64(input.After)
+			if len(events) > 0 {
+				next = events[len(events)-1].ID
+			}
+
+			err = app.writeResponse(w, r, http.StatusOK, envelope{"events": events, "next": next}, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		case <-timeout.C:
+		// Respond with whatever there is (probably nothing) when the server shuts down
+		case <-app.events.Done():
+			deadline = time.Now()
+		}
+	}
+}
+
+// Streams movie changes to the client as Server-Sent Events. Each event's ID is its
+// position in the change feed, its name is "created", "updated" or "deleted", and its
+// data is the movie as JSON (just its ID, for deletions). A client which reconnects with
+// a Last-Event-ID header is sent everything it missed; otherwise the stream starts with
+// the next change
+func (app *application) streamMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	wake, unsubscribe := app.events.Subscribe()
+	defer unsubscribe()
+
+	var (
+		lastID int64
+		err    error
+	)
+
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastID, err = strconv.ParseInt(header, 10, 64)
+		if err != nil || lastID < 0 {
+			app.badRequestResponse(w, r, fmt.Errorf("invalid Last-Event-ID header"))
+			return
+		}
+	} else {
+		lastID, err = app.models.Events.LatestID(r.Context())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The stream stays open indefinitely, so remove the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Ask the client to wait 5 seconds before reconnecting if the stream drops
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		events, err := app.models.Events.GetAfter(r.Context(), lastID, 100)
+		if err != nil {
+			// The response has already started, so all we can do is log the error and
+			// end the stream. The client will reconnect and resume from its last event
+			if r.Context().Err() == nil {
+				app.logError(r, err)
+			}
+
+			return
+		}
+
+		for _, event := range events {
+			lastID = event.ID
+
+			name, ok := strings.CutPrefix(event.Type, "movie.")
+			if !ok {
+				continue
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, name, event.Payload)
+		}
+
+		if len(events) > 0 {
+			err = rc.Flush()
+			if err != nil {
+				return
+			}
+
+			// Go straight back for more if this was a full page
+			if len(events) == 100 {
+				continue
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-app.events.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+
+			err = rc.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/azizjon12/greenlight/internal/msgpack"
+)
+
+// A format is one of the encodings the API can read and write. JSON is the native format. The
+// others are converted to and from JSON, so they share the json struct tags and custom
+// marshallers such as data.Runtime's "N mins"
+type format struct {
+	name        string
+	contentType string
+}
+
+var (
+	formatJSON    = format{name: "JSON", contentType: "application/json"}
+	formatXML     = format{name: "XML", contentType: "application/xml"}
+	formatMsgpack = format{name: "MessagePack", contentType: "application/msgpack"}
+)
+
+// Media types recognised in the Accept and Content-Type headers
+var mediaTypeFormats = map[string]format{
+	"application/json":        formatJSON,
+	"application/xml":         formatXML,
+	"text/xml":                formatXML,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+}
+
+// negotiateFormat() picks the response format from the Accept header, taking the listed format
+// with the highest quality value, or the first of them on a tie. JSON is used if the header is
+// missing, allows any type, or lists nothing we support
+func negotiateFormat(header []string) format {
+	best, bestQ := formatJSON, 0.0
+
+	for _, value := range header {
+		for part := range strings.SplitSeq(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+			}
+
+			f, ok := mediaTypeFormats[mediaType]
+			if !ok {
+				if mediaType != "*/*" && mediaType != "application/*" {
+					continue
+				}
+				f = formatJSON
+			}
+
+			if q > bestQ {
+				best, bestQ = f, q
+			}
+		}
+	}
+
+	return best
+}
+
+// requestFormat() returns the format of the request body given by its Content-Type header.
+// Anything unrecognised is read as JSON, as clients such as curl send JSON bodies labelled as
+// form data by default
+func requestFormat(r *http.Request) format {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return formatJSON
+	}
+
+	f, ok := mediaTypeFormats[mediaType]
+	if !ok {
+		return formatJSON
+	}
+
+	return f
+}
+
+// A document is a format-neutral copy of a JSON value which keeps the order of object members.
+// Its values are nil, bool, json.Number, string, []any and object
+type object []member
+
+type member struct {
+	key   string
+	value any
+}
+
+// decodeDocument() reads the next JSON value from dec, which must have UseNumber() set
+func decodeDocument(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := object{}
+
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeDocument(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			obj = append(obj, member{key: key.(string), value: value})
+		}
+
+		_, err = dec.Token()
+		return obj, err
+
+	case json.Delim('['):
+		arr := []any{}
+
+		for dec.More() {
+			value, err := decodeDocument(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			arr = append(arr, value)
+		}
+
+		_, err = dec.Token()
+		return arr, err
+	}
+
+	return tok, nil
+}
+
+// toDocument() converts data to a document by way of its JSON encoding
+func toDocument(data any) (any, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	return decodeDocument(dec)
+}
+
+// writeXML() writes data as XML. The document element is <response>, each object member
+// becomes an element named after its key, and array elements are written as <item> elements.
+// Keys which aren't valid XML names are written as <entry key="...">
+func writeXML(w io.Writer, data any, pretty bool) error {
+	doc, err := toDocument(data)
+	if err != nil {
+		return err
+	}
+
+	io.WriteString(w, xml.Header)
+
+	enc := xml.NewEncoder(w)
+	if pretty {
+		enc.Indent("", "\t")
+	}
+
+	err = encodeXMLElement(enc, "response", doc)
+	if err != nil {
+		return err
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// A loose match for XML names, leaving out the non-ASCII characters XML also allows
+var xmlNameRX = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func encodeXMLElement(enc *xml.Encoder, name string, value any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !xmlNameRX.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case object:
+		for _, m := range value {
+			err = encodeXMLElement(enc, m.key, m.value)
+			if err != nil {
+				return err
+			}
+		}
+
+	case []any:
+		for _, elem := range value {
+			err = encodeXMLElement(enc, "item", elem)
+			if err != nil {
+				return err
+			}
+		}
+
+	case string:
+		err = enc.EncodeToken(xml.CharData(value))
+	case json.Number:
+		err = enc.EncodeToken(xml.CharData(value))
+	case bool:
+		err = enc.EncodeToken(xml.CharData(strconv.FormatBool(value)))
+	}
+	if err != nil {
+		return err
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// writeMsgpack() writes data as MessagePack
+func writeMsgpack(w io.Writer, data any) error {
+	doc, err := toDocument(data)
+	if err != nil {
+		return err
+	}
+
+	return encodeMsgpackValue(msgpack.NewEncoder(w), doc)
+}
+
+func encodeMsgpackValue(enc *msgpack.Encoder, value any) error {
+	switch value := value.(type) {
+	case object:
+		err := enc.EncodeMapLen(len(value))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range value {
+			err = enc.EncodeString(m.key)
+			if err != nil {
+				return err
+			}
+
+			err = encodeMsgpackValue(enc, m.value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case []any:
+		err := enc.EncodeArrayLen(len(value))
+		if err != nil {
+			return err
+		}
+
+		for _, elem := range value {
+			err = encodeMsgpackValue(enc, elem)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case json.Number:
+		// Use the integer formats where the number allows it, as they are more compact
+		// and decode to integer types
+		if i, err := value.Int64(); err == nil {
+			return enc.EncodeInt(i)
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return enc.EncodeUint(u)
+		}
+
+		f, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat(f)
+	}
+
+	return enc.Encode(value)
+}
+
+// msgpackToJSON() reads a single MessagePack value from r and returns its JSON encoding
+func msgpackToJSON(r io.Reader) ([]byte, error) {
+	dec := msgpack.NewDecoder(r)
+
+	value, err := dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dec.Decode()
+	if !errors.Is(err, io.EOF) {
+		return nil, errMultipleValues
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		// The only MessagePack values with no JSON equivalent are NaN and infinite floats
+		return nil, errors.New("body contains a number which is not finite")
+	}
+
+	return js, nil
+}
+
+var errMultipleValues = errors.New("multiple values in body")
+
+// maxXMLDepth is how deeply XML request elements may be nested
+const maxXMLDepth = 1000
+
+type xmlNode struct {
+	name     string
+	text     strings.Builder
+	children []*xmlNode
+}
+
+// xmlToJSON() reads an XML document from r and returns its JSON equivalent, for decoding into
+// dst. The name of the document element is ignored, and its child elements become the members
+// of a JSON object. XML has no types of its own, so the type of dst decides whether each
+// element becomes a JSON object, array, number, boolean or string. The child elements of an
+// array can have any name
+func xmlToJSON(r io.Reader, dst any) ([]byte, error) {
+	dec := xml.NewDecoder(r)
+
+	var (
+		root  *xmlNode
+		stack []*xmlNode
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if root != nil && len(stack) == 0 {
+				return nil, errMultipleValues
+			}
+			if len(stack) >= maxXMLDepth {
+				line, _ := dec.InputPos()
+				return nil, &xml.SyntaxError{Msg: "exceeded max depth", Line: line}
+			}
+
+			node := &xmlNode{name: tok.Name.Local}
+			if root == nil {
+				root = node
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			}
+			stack = append(stack, node)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(tok)
+			} else if len(bytes.TrimSpace(tok)) > 0 {
+				line, _ := dec.InputPos()
+				return nil, &xml.SyntaxError{Msg: "text outside the document element", Line: line}
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, io.EOF
+	}
+
+	return json.Marshal(xmlValue(root, reflect.TypeOf(dst)))
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	jsonNumberRX        = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+)
+
+// xmlValue() converts node to the JSON value for decoding into type t. If the text of an
+// element doesn't suit t it is left as a string, so that decoding it reports a type error
+func xmlValue(node *xmlNode, t reflect.Type) any {
+	text := strings.TrimSpace(node.text.String())
+
+	if t == nil {
+		return text
+	}
+
+	// Types with their own JSON decoding, such as data.Runtime, are given the element's text
+	if t.Implements(jsonUnmarshalerType) || reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return text
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return xmlValue(node, t.Elem())
+
+	case reflect.Struct:
+		obj := map[string]any{}
+		for _, child := range node.children {
+			obj[child.name] = xmlValue(child, jsonFieldType(t, child.name))
+		}
+		return obj
+
+	case reflect.Map:
+		obj := map[string]any{}
+		for _, child := range node.children {
+			obj[child.name] = xmlValue(child, t.Elem())
+		}
+		return obj
+
+	case reflect.Slice, reflect.Array:
+		// Byte slices are base64 text in JSON, as in XML
+		if t.Elem().Kind() == reflect.Uint8 {
+			return text
+		}
+
+		arr := make([]any, 0, len(node.children))
+		for _, child := range node.children {
+			arr = append(arr, xmlValue(child, t.Elem()))
+		}
+		return arr
+
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if jsonNumberRX.MatchString(text) {
+			return json.Number(text)
+		}
+	}
+
+	return text
+}
+
+// jsonFieldType() returns the type of the struct field which encoding/json would decode the
+// object member key into, or nil if there is none
+func jsonFieldType(t reflect.Type, key string) reflect.Type {
+	var folded reflect.Type
+
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || (field.Anonymous && field.Type.Kind() == reflect.Struct) {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		// encoding/json prefers an exact match, then falls back to a case-insensitive one
+		if name == key {
+			return field.Type
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = field.Type
+		}
+	}
+
+	return folded
+}
+
+// acceptsProblem() reports whether the Accept header opts in to RFC 9457 problem details for
+// error responses, by listing application/problem+json
+func acceptsProblem(header []string) bool {
+	for _, value := range header {
+		for part := range strings.SplitSeq(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || mediaType != "application/problem+json" {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(params["q"], 64)
+			if err != nil || q > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/msgpack"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   format
+	}{
+		{nil, formatJSON},
+		{[]string{"*/*"}, formatJSON},
+		{[]string{"application/xml"}, formatXML},
+		{[]string{"text/xml"}, formatXML},
+		{[]string{"application/msgpack"}, formatMsgpack},
+		{[]string{"application/x-msgpack"}, formatMsgpack},
+		{[]string{"text/html"}, formatJSON},
+		{[]string{"application/xml, application/msgpack"}, formatXML},
+		{[]string{"application/xml;q=0.5, application/msgpack"}, formatMsgpack},
+		{[]string{"application/xml;q=0.9, application/json;q=0.8"}, formatXML},
+		{[]string{"application/json;q=0.1, */*;q=0.2, application/msgpack;q=0.3"}, formatMsgpack},
+		{[]string{"application/xml;q=0", "application/msgpack;q=0.1"}, formatMsgpack},
+		{[]string{"application/xml;q=0"}, formatJSON},
+		{[]string{"application/xml;q=bad, application/msgpack;q=0.5"}, formatMsgpack},
+		{[]string{"application/xml;q=0.5", "application/msgpack;q=0.5"}, formatXML},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.accept, " | "), func(t *testing.T) {
+			if got := negotiateFormat(tt.accept); got != tt.want {
+				t.Errorf("got %s; want %s", got.name, tt.want.name)
+			}
+		})
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	app := &application{}
+
+	movie := &data.Movie{
+		ID:      7,
+		Title:   "Moana <Special> & \"Extended\"",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+		Version: 3,
+	}
+
+	for _, f := range []format{formatJSON, formatXML, formatMsgpack} {
+		t.Run(f.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/7", nil)
+			r.Header.Set("Accept", f.contentType)
+			w := httptest.NewRecorder()
+
+			err := app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != f.contentType {
+				t.Errorf("got Content-Type %q; want %q", got, f.contentType)
+			}
+
+			body := w.Body.Bytes()
+
+			// The runtime is written in its "N mins" form whatever the format
+			switch f {
+			case formatXML:
+				if !bytes.Contains(body, []byte("<runtime>107 mins</runtime>")) {
+					t.Errorf("XML body has no runtime element:\n%s", body)
+				}
+
+			case formatMsgpack:
+				value, err := msgpack.NewDecoder(bytes.NewReader(body)).Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := value.(map[string]any)["movie"].(map[string]any)["runtime"]
+				if got != "107 mins" {
+					t.Errorf("got MessagePack runtime %#v; want %q", got, "107 mins")
+				}
+
+			default:
+				if !bytes.Contains(body, []byte(`"runtime":"107 mins"`)) {
+					t.Errorf("JSON body has no runtime member:\n%s", body)
+				}
+			}
+
+			// Send the response straight back as a request body
+			r = httptest.NewRequest(http.MethodPost, "/v1/movies", bytes.NewReader(body))
+			r.Header.Set("Content-Type", f.contentType)
+			w = httptest.NewRecorder()
+
+			var input struct {
+				Movie data.Movie `json:"movie"`
+			}
+
+			err = app.readRequest(w, r, &input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := input.Movie
+			if got.ID != movie.ID || got.Title != movie.Title || got.Year != movie.Year ||
+				got.Runtime != movie.Runtime || !slices.Equal(got.Genres, movie.Genres) || got.Version != movie.Version {
+				t.Errorf("got %+v; want %+v", got, *movie)
+			}
+		})
+	}
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name   string
+		format format
+		body   []byte
+		want   string
+	}{
+		{"JSON empty", formatJSON, nil, "body must not be empty"},
+		{"JSON malformed", formatJSON, []byte(`{"title": }`), "body contains badly-formed JSON (at character 11)"},
+		{"JSON truncated", formatJSON, []byte(`{"title": "Moana"`), "body contains badly-formed JSON"},
+		{"JSON wrong type", formatJSON, []byte(`{"year": "2016"}`), `body contains incorrect JSON type for field "year"`},
+		{"JSON runtime", formatJSON, []byte(`{"runtime": 107}`), "invalid runtime format"},
+		{"JSON unknown key", formatJSON, []byte(`{"rating": 5}`), `body contains unknown key "rating"`},
+		{"JSON two values", formatJSON, []byte(`{} {}`), "body must only contain a single JSON value"},
+
+		{"XML empty", formatXML, nil, "body must not be empty"},
+		{"XML malformed", formatXML, []byte("<movie>\n<title>Moana</movie>"), "body contains badly-formed XML (at line 2)"},
+		{"XML truncated", formatXML, []byte("<movie><title>Moana</title>"), "body contains badly-formed XML (at line 1)"},
+		{"XML too deep", formatXML, []byte(strings.Repeat("<a>", 1001)), "body contains badly-formed XML (at line 1)"},
+		{"XML wrong type", formatXML, []byte("<movie><year>recent</year></movie>"), `body contains incorrect XML type for field "year"`},
+		{"XML runtime", formatXML, []byte("<movie><runtime>107</runtime></movie>"), "invalid runtime format"},
+		{"XML two documents", formatXML, []byte("<movie/><movie/>"), "body must only contain a single XML value"},
+
+		{"MessagePack empty", formatMsgpack, nil, "body must not be empty"},
+		{"MessagePack malformed", formatMsgpack, []byte{0x81, 0xa5, 't', 'i', 't', 'l', 'e', 0xc1}, "body contains badly-formed MessagePack (at byte 7)"},
+		{"MessagePack truncated", formatMsgpack, []byte{0x81, 0xa5, 't', 'i', 't'}, "body contains badly-formed MessagePack"},
+		{"MessagePack too deep", formatMsgpack, append(bytes.Repeat([]byte{0x91}, 1001), 0xc0), "body contains badly-formed MessagePack (at byte 1000)"},
+		{"MessagePack extension", formatMsgpack, []byte{0xd4, 0x01, 0x00}, "body contains a MessagePack extension type, which is not supported"},
+		{"MessagePack runtime", formatMsgpack, []byte{0x81, 0xa7, 'r', 'u', 'n', 't', 'i', 'm', 'e', 0x6b}, "invalid runtime format"},
+		{"MessagePack two values", formatMsgpack, []byte{0x80, 0x80}, "body must only contain a single MessagePack value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.format.contentType)
+			w := httptest.NewRecorder()
+
+			var input struct {
+				Title   string       `json:"title"`
+				Year    int32        `json:"year"`
+				Runtime data.Runtime `json:"runtime"`
+			}
+
+			err := app.readRequest(w, r, &input)
+			if err == nil {
+				t.Fatalf("got no error; want %q", tt.want)
+			}
+
+			if err.Error() != tt.want {
+				t.Errorf("got error %q; want %q", err, tt.want)
+			}
+		})
+	}
+}
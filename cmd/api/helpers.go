@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -9,9 +13,16 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/mailer"
+	"github.com/azizjon12/greenlight/internal/msgpack"
 	"github.com/azizjon12/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
+	"golang.org/x/text/language"
 )
 
 type envelope map[string]any
@@ -29,18 +40,52 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
-// Takes the destination http.ResponseWriter, the HTTP status code to send, the data to encode to JSON
-// and a headers map containing any additional HTTP headers we want to include in the response
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// Use the json.MarshalIndent() function so that whitespace is added to the encoded JSON.
-	// Here, we use no line prefix ("") and tab indents ("\t") for each element
-	js, err := json.MarshalIndent(data, "", "\t")
+// responseBufferPool holds the buffers responses are encoded into, so that each response
+// doesn't allocate and grow a new one
+var responseBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// Takes the destination http.ResponseWriter, the request being answered, the HTTP status code to
+// send, the data to encode and a headers map containing any additional HTTP headers we want to
+// include in the response. The data is encoded as JSON, XML or MessagePack, as negotiated with
+// the request's Accept header
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	buf := responseBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		// Don't keep unusually large buffers around, or one big response would pin
+		// its memory for good
+		if buf.Cap() <= 64*1024 {
+			responseBufferPool.Put(buf)
+		}
+	}()
+
+	// Encode into the buffer rather than straight to the ResponseWriter, so that an encoding
+	// error can still be reported with a proper error response. Output is compact unless
+	// pretty-printing was asked for, in which case use tab indents for each element
+	format := negotiateFormat(r.Header.Values("Accept"))
+	pretty := app.prettyOutput(r)
+
+	var err error
+
+	switch format {
+	case formatXML:
+		err = writeXML(buf, data, pretty)
+	case formatMsgpack:
+		err = writeMsgpack(buf, data)
+	default:
+		// Encode() ends the output with a newline
+		enc := json.NewEncoder(buf)
+		if pretty {
+			enc.SetIndent("", "\t")
+		}
+		err = enc.Encode(data)
+	}
 	if err != nil {
 		return err
 	}
 
-	js = append(js, '\n')
-
 	// Loop through the headers map (which has the type map[string][]string)
 	// and add all the header key and values to the http.ResponseWriter's header map
 	for key, values := range headers {
@@ -49,77 +94,229 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", format.contentType)
 	w.WriteHeader(status)
-	w.Write(js)
+	buf.WriteTo(w)
 
 	return nil
 }
 
-func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+// prettyOutput() reports whether a JSON or XML response should be indented. The ?pretty=true
+// or ?pretty=false query string parameter decides if present, and otherwise responses are
+// only indented in the development environment
+func (app *application) prettyOutput(r *http.Request) bool {
+	pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if err != nil {
+		return app.config.env == "development"
+	}
+
+	return pretty
+}
+
+// lastModifiedHeader() returns the Last-Modified header for content that last changed at t,
+// ready to be passed to writeResponse(). The zero time means the change time is unknown, and no
+// header is set
+func lastModifiedHeader(t time.Time) http.Header {
+	headers := make(http.Header)
+	if t.IsZero() {
+		return headers
+	}
+
+	headers.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+
+	return headers
+}
+
+// notModified() checks the request's If-Modified-Since header against t, the time the content
+// last changed. If the client's copy is still current it sends a 304 Not Modified response and
+// returns true, and the handler should return without writing a body
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, t time.Time) bool {
+	if t.IsZero() || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	// Last-Modified only has a precision of one second, so drop the fractional part
+	// before comparing
+	if t.Truncate(time.Second).After(since) {
+		return false
+	}
+
+	for key, values := range lastModifiedHeader(t) {
+		w.Header()[key] = values
+	}
+
+	// A 304 must carry the same Vary header as the 200 it stands in for, or a cache could
+	// reuse its stored copy for a client which asked for another format
+	w.Header().Add("Vary", "Accept")
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// readRequest() decodes the request body into dst. The body is read as XML or MessagePack if
+// its Content-Type header says so, and as JSON otherwise. XML and MessagePack bodies are first
+// converted to JSON, so that every format is decoded by the same rules
+func (app *application) readRequest(w http.ResponseWriter, r *http.Request, dst any) error {
 	// Use http.MaxBytesReader() to limit the size of the request body to 1,048,576 bytes (1MB)
 	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
 
+	format := requestFormat(r)
+	body := io.Reader(r.Body)
+
+	if format != formatJSON {
+		var (
+			js  []byte
+			err error
+		)
+
+		if format == formatXML {
+			js, err = xmlToJSON(r.Body, dst)
+		} else {
+			js, err = msgpackToJSON(r.Body)
+		}
+		if err != nil {
+			return bodyError(format, err)
+		}
+
+		body = bytes.NewReader(js)
+	}
+
 	// Initialize Decoder() and call the DisallowUnknownFields() method on it before decoding
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	// Decode the request body into the target destination
 	err := dec.Decode(dst)
 	if err != nil {
-		// If there is an error during the decoding, start the triage ...
-		var (
-			syntaxError           *json.SyntaxError
-			unmarshalTypeError    *json.UnmarshalTypeError
-			invalidUnmarshalError *json.InvalidUnmarshalError
-			maxBytesError         *http.MaxBytesError
-		)
+		return bodyError(format, err)
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return bodyError(format, errMultipleValues)
+	}
 
-		switch {
-		// Use error.As() function to check whether the error has the type
-		// *json.SyntaxError. If so, return user friendly error message
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+	return nil
+}
+
+// bodyError() translates an error from reading a request body of the given format into a user
+// friendly one
+func bodyError(format format, err error) error {
+	// If there is an error during the decoding, start the triage ...
+	var (
+		syntaxError           *json.SyntaxError
+		xmlSyntaxError        *xml.SyntaxError
+		msgpackSyntaxError    *msgpack.SyntaxError
+		unmarshalTypeError    *json.UnmarshalTypeError
+		invalidUnmarshalError *json.InvalidUnmarshalError
+		maxBytesError         *http.MaxBytesError
+		corruptInputError     flate.CorruptInputError
+	)
+
+	switch {
+	// Use error.As() function to check whether the error has the type
+	// *json.SyntaxError. If so, return user friendly error message
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+	case errors.As(err, &xmlSyntaxError):
+		return fmt.Errorf("body contains badly-formed XML (at line %d)", xmlSyntaxError.Line)
+
+	case errors.As(err, &msgpackSyntaxError):
+		return fmt.Errorf("body contains badly-formed MessagePack (at byte %d)", msgpackSyntaxError.Offset)
+
+	case errors.Is(err, msgpack.ErrUnsupported):
+		return errors.New("body contains a MessagePack extension type, which is not supported")
+
+	// Sometimes, Decode() may also return an io.ErrUnexpectedEOF error for syntax errorrs in the JSON
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("body contains badly-formed %s", format.name)
+
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect %s type for field %q", format.name, unmarshalTypeError.Field)
+		}
+		// The offset is only meaningful in a body which was sent as JSON
+		if format != formatJSON {
+			return fmt.Errorf("body contains incorrect %s type", format.name)
+		}
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
 
-		// Sometimes, Decode() may also return an io.ErrUnexpectedEOF error for syntax errorrs in the JSON
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+	// If the request body is empty, an io.EOF error is returned
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+	case errors.Is(err, errMultipleValues):
+		return fmt.Errorf("body must only contain a single %s value", format.name)
 
-		// If the request body is empty, an io.EOF error is returned
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+	// If the body contains a field which cannot be mapped to the destination
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown key %s", fieldName)
+
+	// Check for size limit of 1MB (*http.MaxBytesError)
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+
+	// A gzip request body which is damaged part way through
+	case errors.Is(err, gzip.ErrChecksum), errors.As(err, &corruptInputError):
+		return errors.New("body contains corrupt gzip data")
+
+	// If something with non-nil pointer is passed, below error is returned
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+
+	// For any other error, return it as-is
+	default:
+		return err
+	}
+}
 
-		// If the JSON contains a field which cannot be mapped to the destination
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+// readBearerToken() extracts the token from an "Authorization: Bearer <token>" header,
+// returning false if the header is missing or isn't in the expected format
+func (app *application) readBearerToken(r *http.Request) (string, bool) {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return "", false
+	}
 
-		// Check for size limit of 1MB (*http.MaxBytesError)
-		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	return headerParts[1], true
+}
 
-		// If something with non-nil pointer is passed, below error is returned
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
+// readClient() returns the user agent and IP address of the client making the request
+func (app *application) readClient(r *http.Request) data.Client {
+	return data.Client{
+		UserAgent: r.UserAgent(),
+		IP:        realip.FromRequest(r),
+	}
+}
 
-		// For any other error, return it as-is
-		default:
-			return err
+// readLocale() returns the locale a user asked for, or failing that their most preferred
+// language from the Accept-Language header, or the default locale. A requested locale
+// which isn't a valid language tag is returned unchanged, for validation to reject
+func (app *application) readLocale(r *http.Request, requested string) string {
+	if requested != "" {
+		tag, err := language.Parse(requested)
+		if err != nil {
+			return requested
 		}
+
+		return tag.String()
 	}
 
-	err = dec.Decode(&struct{}{})
-	if !errors.Is(err, io.EOF) {
-		return errors.New("body must only contain a single JSON value")
+	// ParseAcceptLanguage() returns the tags in order of preference
+	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err == nil && len(tags) > 0 && tags[0] != language.Und {
+		return tags[0].String()
 	}
 
-	return nil
+	return mailer.DefaultLocale
 }
 
 // readString() helper returns a string value from the query string, or default value if not provided
@@ -157,13 +354,51 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Convert the value to an int. If fails return error to validator instance and return default value
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddErrorCode(key, validator.CodeInvalidType, "must be an integer value")
 		return defaultValue
 	}
 
 	return i
 }
 
+// readBool() returns a pointer to a boolean value from the query string, or the default
+// value if not provided. A nil pointer lets callers tell "not filtered" apart from false
+func (app *application) readBool(qs url.Values, key string, defaultValue *bool, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddErrorCode(key, validator.CodeInvalidType, "must be a boolean value")
+		return defaultValue
+	}
+
+	return &b
+}
+
+// readTime() returns a pointer to a time value from the query string, accepting either
+// an RFC 3339 timestamp or a plain YYYY-MM-DD date, or the default value if not provided
+func (app *application) readTime(qs url.Values, key string, defaultValue *time.Time, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return &t
+		}
+	}
+
+	v.AddError(key, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return defaultValue
+}
+
 func (app *application) background(fn func()) {
 	// Launch a background goroutine using WaitGroup instead of regular go()
 	app.wg.Go(func() {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+)
+
+func TestNotModified(t *testing.T) {
+	app := &application{}
+
+	modified := time.Date(2026, 3, 4, 5, 6, 7, 890, time.UTC)
+
+	tests := []struct {
+		name  string
+		since string
+		want  bool
+	}{
+		{"no header", "", false},
+		{"same second", modified.Format(http.TimeFormat), true},
+		{"later", modified.Add(time.Hour).Format(http.TimeFormat), true},
+		{"earlier", modified.Add(-time.Second).Format(http.TimeFormat), false},
+		{"malformed", "yesterday", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.since != "" {
+				r.Header.Set("If-Modified-Since", tt.since)
+			}
+
+			w := httptest.NewRecorder()
+
+			if got := app.notModified(w, r, modified); got != tt.want {
+				t.Fatalf("got %t; want %t", got, tt.want)
+			}
+
+			if !tt.want {
+				return
+			}
+
+			if w.Code != http.StatusNotModified {
+				t.Errorf("got status %d; want %d", w.Code, http.StatusNotModified)
+			}
+
+			if got := w.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+				t.Errorf("got Last-Modified %q; want %q", got, modified.Format(http.TimeFormat))
+			}
+
+			if !slices.Contains(w.Header().Values("Vary"), "Accept") {
+				t.Errorf("got Vary %q; want it to include Accept", w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+// discardResponseWriter is a ResponseWriter which throws the body away, so that benchmarks
+// measure the encoding rather than the recording of the response
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(status int)      {}
+
+// benchmarkEnvelope() returns a page of movies, as sent by listMoviesHandler
+func benchmarkEnvelope() envelope {
+	movies := make([]*data.Movie, 20)
+	for i := range movies {
+		movies[i] = &data.Movie{
+			ID:      int64(i + 1),
+			Title:   fmt.Sprintf("Movie %d", i+1),
+			Year:    2000 + int32(i),
+			Runtime: data.Runtime(90 + i),
+			Genres:  []string{"drama", "comedy", "sci-fi"},
+			Version: 1,
+		}
+	}
+
+	return envelope{"movies": movies, "metadata": data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 5, TotalRecords: 100}}
+}
+
+func BenchmarkWriteResponse(b *testing.B) {
+	app := &application{}
+	env := benchmarkEnvelope()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		clear(w.header)
+
+		err := app.writeResponse(w, r, http.StatusOK, env, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMarshalIndent measures the way responses were written before writeResponse(),
+// with json.MarshalIndent() allocating a new indented buffer for every response
+func BenchmarkMarshalIndent(b *testing.B) {
+	env := benchmarkEnvelope()
+
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		clear(w.header)
+
+		js, err := json.MarshalIndent(env, "", "\t")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		js = append(js, '\n')
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/mailer"
+)
+
+// The kinds of job the workers know how to run
+const (
+	jobSendEmail      = "send_email"
+	jobDeliverWebhook = data.JobDeliverWebhook
+)
+
+// The payload for a send_email job. Secrets are merged into Data when the email is sent,
+// but are kept apart in the payload so the queue can remove them if the job dies
+type emailJob struct {
+	OutboxID  int64          `json:"outbox_id"`
+	Recipient string         `json:"recipient"`
+	Locale    string         `json:"locale"`
+	Template  string         `json:"template"`
+	Data      map[string]any `json:"data"`
+	Secrets   map[string]any `json:"secrets,omitempty"`
+}
+
+// errPermanentJob marks a job failure which retrying won't fix. The job is moved straight
+// to the dead state instead of using up its remaining attempts
+var errPermanentJob = errors.New("permanent job failure")
+
+// enqueueEmail() queues an email to be sent by the job workers. Unlike sending it from a
+// background goroutine, the email survives the process dying and is retried on failure.
+// Each email is also recorded in the outbox, so its delivery status can be looked up later.
+// The email is sent to the user's address, using the templates for their locale. Template
+// data which mustn't outlive the job, such as token plaintexts, goes in secrets
+func (app *application) enqueueEmail(user *data.User, templateFile string, templateData, secrets map[string]any) error {
+	email := &data.OutboxEmail{
+		Template:  templateFile,
+		Recipient: user.Email,
+	}
+
+	return app.models.Outbox.Insert(email, jobSendEmail, func(outboxID int64) any {
+		return emailJob{
+			OutboxID:  outboxID,
+			Recipient: user.Email,
+			Locale:    user.Locale,
+			Template:  templateFile,
+			Data:      templateData,
+			Secrets:   secrets,
+		}
+	}, app.config.jobs.maxAttempts)
+}
+
+// runJob() dispatches a job to the function for its kind
+func (app *application) runJob(job *data.Job) error {
+	switch job.Kind {
+	case jobSendEmail:
+		var payload emailJob
+
+		// Decode numbers in the template data as json.Number rather than float64, so that
+		// IDs and the like are printed as they were queued instead of as 1.234567e+06
+		dec := json.NewDecoder(bytes.NewReader(job.Payload))
+		dec.UseNumber()
+
+		err := dec.Decode(&payload)
+		if err != nil {
+			return err
+		}
+
+		if payload.Data == nil {
+			payload.Data = map[string]any{}
+		}
+		maps.Copy(payload.Data, payload.Secrets)
+
+		err = app.mailer.Send(payload.Recipient, payload.Locale, payload.Template, payload.Data)
+		if errors.Is(err, mailer.ErrPermanent) {
+			err = fmt.Errorf("%w: %w", errPermanentJob, err)
+		}
+
+		app.recordEmailDelivery(job, payload.OutboxID, err)
+		return err
+
+	case jobDeliverWebhook:
+		var payload webhookJob
+
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return err
+		}
+
+		return app.deliverWebhook(job, payload.DeliveryID)
+
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
+// recordEmailDelivery() updates the outbox with the outcome of a delivery attempt. The
+// email has failed for good if the error is permanent or this was the job's last attempt
+func (app *application) recordEmailDelivery(job *data.Job, outboxID int64, sendErr error) {
+	// Emails queued before the outbox existed have no record to update
+	if outboxID == 0 {
+		return
+	}
+
+	var err error
+
+	if sendErr == nil {
+		err = app.models.Outbox.MarkSent(outboxID)
+	} else {
+		final := errors.Is(sendErr, errPermanentJob) || job.Attempts >= job.MaxAttempts
+		err = app.models.Outbox.RecordFailure(outboxID, sendErr, final)
+	}
+
+	if err != nil {
+		app.logger.Error("unable to update email outbox", "outbox_id", outboxID, "error", err.Error())
+	}
+}
+
+// startWorkers() launches the configured number of job workers. They keep claiming and
+// running jobs until ctx is cancelled, at which point they finish the job in hand and
+// return. Workers are tracked by the application WaitGroup, so the shutdown sequence in
+// serve() waits for them to drain
+func (app *application) startWorkers(ctx context.Context) {
+	for i := range app.config.jobs.workers {
+		app.wg.Go(func() {
+			app.logger.Info("starting job worker", "worker", i)
+
+			for {
+				worked := app.runNextJob(ctx)
+
+				// Go straight back for more work while there is some, otherwise wait
+				// for the next poll (or for shutdown)
+				if worked {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(app.config.jobs.pollInterval):
+				}
+			}
+		})
+	}
+}
+
+// runNextJob() claims and runs a single job, returning false if there was nothing to do
+func (app *application) runNextJob(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	app.buryExpiredJobs(ctx)
+
+	job, err := app.models.Jobs.Claim(ctx)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) && ctx.Err() == nil {
+			app.logger.Error("unable to claim job", "error", err.Error())
+		}
+
+		return false
+	}
+
+	// Recover from any panic in the job, treating it as a failed attempt
+	err = func() (err error) {
+		defer func() {
+			if pv := recover(); pv != nil {
+				err = fmt.Errorf("panic: %v", pv)
+			}
+		}()
+
+		return app.runJob(job)
+	}()
+
+	if err == nil {
+		err = app.models.Jobs.Complete(job.ID)
+		if err != nil {
+			app.logger.Error("unable to complete job", "job_id", job.ID, "error", err.Error())
+		}
+
+		return true
+	}
+
+	// Don't retry a job which can never succeed
+	if errors.Is(err, errPermanentJob) {
+		job.Attempts = max(job.Attempts, job.MaxAttempts)
+	}
+
+	err = app.models.Jobs.Fail(job, err, time.Now().Add(app.jobBackoff(job.Attempts)))
+	if err != nil {
+		app.logger.Error("unable to record job failure", "job_id", job.ID, "error", err.Error())
+		return true
+	}
+
+	if job.Status == data.JobDead {
+		app.logger.Error("job failed permanently", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", job.LastError)
+	} else {
+		app.logger.Warn("job failed, will retry", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "run_at", job.RunAt, "error", job.LastError)
+	}
+
+	return true
+}
+
+// buryExpiredJobs() moves jobs whose worker died during their final attempt to the dead
+// state, since Claim() won't give them another go
+func (app *application) buryExpiredJobs(ctx context.Context) {
+	jobs, err := app.models.Jobs.BuryExpired(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			app.logger.Error("unable to bury expired jobs", "error", err.Error())
+		}
+
+		return
+	}
+
+	for _, job := range jobs {
+		app.logger.Error("job failed permanently", "job_id", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", job.LastError)
+
+		// The outbox would otherwise show the email as queued forever
+		if job.Kind == jobSendEmail {
+			var payload emailJob
+
+			err := json.Unmarshal(job.Payload, &payload)
+			if err != nil {
+				app.logger.Error("unable to decode job payload", "job_id", job.ID, "error", err.Error())
+				continue
+			}
+
+			app.recordEmailDelivery(job, payload.OutboxID, errors.New(job.LastError))
+		}
+	}
+}
+
+// jobBackoff() returns the delay before retrying a job which has failed a number of
+// times, doubling with each attempt and capped at one hour
+func (app *application) jobBackoff(attempts int) time.Duration {
+	delay := app.config.jobs.backoff
+
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+
+	return min(delay, time.Hour)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/mailer"
+)
+
+func TestSendEmailJobKeepsLargeIDs(t *testing.T) {
+	transport := mailer.NewMemoryTransport()
+
+	m, err := mailer.New(transport, "Greenlight <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		mailer: m,
+	}
+
+	for _, locale := range []string{"en", "es"} {
+		t.Run(locale, func(t *testing.T) {
+			// Queue the payload the way enqueueEmail() does, by encoding it as JSON
+			payload, err := json.Marshal(emailJob{
+				Recipient: "alice@example.com",
+				Locale:    locale,
+				Template:  "user_welcome.tmpl",
+				Data: map[string]any{
+					"activationTTL": "72h0m0s",
+					"name":          "Alice Smith",
+					"userID":        int64(1_234_567),
+				},
+				Secrets: map[string]any{
+					"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			job := &data.Job{Kind: jobSendEmail, Payload: payload, Attempts: 1, MaxAttempts: 3}
+
+			err = app.runJob(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := transport.Messages()
+			msg := messages[len(messages)-1]
+
+			for name, body := range map[string]string{"plain": msg.PlainBody, "HTML": msg.HTMLBody} {
+				if !strings.Contains(body, "1234567") || strings.Contains(body, "e+06") {
+					t.Errorf("%s body doesn't contain the user ID as queued:\n%s", name, body)
+				}
+
+				if !strings.Contains(body, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU") {
+					t.Errorf("%s body doesn't contain the activation token:\n%s", name, body)
+				}
+			}
+		})
+	}
+}
@@ -3,21 +3,35 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/jwt"
 	"github.com/azizjon12/greenlight/internal/mailer"
+	"github.com/azizjon12/greenlight/internal/validator"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Declare a string containing the application version number.
 // Later we will try to generate this automatically at build time
 const version = "1.0.0"
 
+// The supported authentication modes. In stateful mode authentication tokens are looked up
+// in the database, while in jwt mode they are self-contained signed JWTs
+const (
+	authModeStateful = "stateful"
+	authModeJWT      = "jwt"
+)
+
 // Define a config struct to hold all the configuration settings for our application.
 type config struct {
 	port int
@@ -44,7 +58,66 @@ type config struct {
 		username string
 		password string
 		sender   string
+		poolSize int
+	}
+
+	// Add a mail struct to choose how emails are delivered
+	mail struct {
+		transport    string
+		dir          string
+		templatesDir string
+	}
+
+	// Add a cache struct to hold the movie read cache settings
+	cache struct {
+		size int
+		ttl  time.Duration
+	}
+
+	// Add a httpCache struct to hold how long shared caches may keep public responses
+	httpCache struct {
+		maxAge time.Duration
+	}
+
+	// Add a jobs struct to hold the background job worker pool settings
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+		maxAttempts  int
+		backoff      time.Duration
+	}
+
+	// Add a login struct to hold the failed login throttling settings
+	login struct {
+		maxAttempts  int
+		backoffBase  time.Duration
+		lockout      time.Duration
+		responseTime time.Duration
+	}
+
+	// Add a password struct to hold the password policy settings
+	password struct {
+		minLength    int
+		minEntropy   float64
+		breachedFile string
+		hasher       string
+		bcryptCost   int
 	}
+
+	// Add an auth struct to hold the authentication mode and the JWT settings
+	auth struct {
+		mode string
+		jwt  struct {
+			keys     string
+			issuer   string
+			audience string
+			ttl      time.Duration
+		}
+	}
+
+	// The base URL of the problem types in problem details responses. If it's empty every
+	// problem has the type about:blank
+	problemTypeBase string
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
@@ -54,7 +127,11 @@ type application struct {
 	logger *slog.Logger
 	models data.Models
 	mailer *mailer.Mailer
+	jwt    *jwt.Signer // Only set when running in jwt auth mode
+	events *eventBroker
 	wg     sync.WaitGroup
+
+	passwordPolicy validator.PasswordPolicy
 }
 
 func main() {
@@ -84,12 +161,66 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("GL_SMTP_USERNAME"), "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("GL_SMTP_PASSWORD"), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.azizhaknazarov.com>", "SMTP sender")
+	flag.IntVar(&cfg.smtp.poolSize, "smtp-pool-size", 2, "Number of SMTP connections to keep open")
+
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "Mail transport (smtp|file|memory)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory for .eml files written by the file mail transport")
+	flag.StringVar(&cfg.mail.templatesDir, "mail-templates-dir", "", "Reload mail templates from this directory on every send (development only)")
+
+	flag.IntVar(&cfg.cache.size, "cache-size", 10_000, "Maximum entries in the movie read cache (0 disables it)")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", time.Minute, "How long movie read cache entries are kept")
+
+	flag.DurationVar(&cfg.httpCache.maxAge, "http-cache-max-age", time.Minute, "max-age sent with cacheable public responses")
+
+	flag.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Number of background job workers")
+	flag.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "How often idle job workers check for new jobs")
+	flag.IntVar(&cfg.jobs.maxAttempts, "jobs-max-attempts", 8, "Attempts before a failing job is marked dead")
+	flag.DurationVar(&cfg.jobs.backoff, "jobs-backoff", 10*time.Second, "Delay before retrying a failed job, doubling with each attempt")
+
+	flag.IntVar(&cfg.login.maxAttempts, "login-max-attempts", 5, "Failed logins before an account is locked")
+	flag.DurationVar(&cfg.login.backoffBase, "login-backoff", time.Second, "Delay after the first failed login, doubling with each failure")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long an account stays locked")
+	flag.DurationVar(&cfg.login.responseTime, "login-response-time", time.Second, "Fixed response time for logins, whether or not they succeed")
+
+	flag.IntVar(&cfg.password.minLength, "password-min-length", 8, "Minimum password length in bytes")
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", 40, "Minimum estimated password entropy in bits")
+	flag.StringVar(&cfg.password.breachedFile, "password-breached-file", "", "File of breached password SHA-1 hashes")
+	flag.StringVar(&cfg.password.hasher, "password-hasher", "bcrypt", "Password hashing algorithm (bcrypt|argon2id)")
+	flag.IntVar(&cfg.password.bcryptCost, "bcrypt-cost", 12, "bcrypt cost for new password hashes")
+
+	// Read the authentication settings. The JWT keys are a comma-separated list in the format
+	// <kid>:<alg>:<base64 key>, where the first key signs new tokens and the rest only verify
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeStateful, "Authentication mode (stateful|jwt)")
+	flag.StringVar(&cfg.auth.jwt.keys, "jwt-keys", os.Getenv("GREENLIGHT_JWT_KEYS"), "JWT signing keys")
+	flag.StringVar(&cfg.auth.jwt.issuer, "jwt-issuer", "greenlight", "JWT issuer")
+	flag.StringVar(&cfg.auth.jwt.audience, "jwt-audience", "greenlight", "JWT audience")
+	flag.DurationVar(&cfg.auth.jwt.ttl, "jwt-ttl", 15*time.Minute, "JWT lifetime")
+
+	flag.StringVar(&cfg.problemTypeBase, "problem-type-base", "https://greenlight.azizhaknazarov.com/problems/", "Base URL of problem types, or empty for about:blank")
 
 	flag.Parse()
 
 	// Initialize a new structured logger which writes log entries to the std out stream
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	signer, err := openJWT(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = setPasswordHasher(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	passwordPolicy, err := openPasswordPolicy(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	// Create db connection
 	db, err := openDB(cfg)
 	if err != nil {
@@ -103,18 +234,73 @@ func main() {
 	// Log a message to say that the connection has been successful
 	logger.Info("database connection pool established")
 
-	mailer, err := mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+	models := data.NewModels(db)
+
+	// Webhook deliveries are queued by the models, in the same transaction as the change
+	// which caused them, so they need to know how many attempts each delivery job gets
+	models.Movies.DeliveryAttempts = cfg.jobs.maxAttempts
+	models.Users.DeliveryAttempts = cfg.jobs.maxAttempts
+
+	// Cache movie reads in memory, and publish the cache's hit and miss counts alongside
+	// the other expvar metrics
+	if cfg.cache.size > 0 {
+		cache := data.NewLRUCache(cfg.cache.size, cfg.cache.ttl)
+		models.Movies.Cache = cache
+
+		expvar.Publish("movie_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+	}
+
+	// Listen for change feed and cache invalidation notifications on a dedicated connection
+	events, err := newEventBroker(cfg.db.dsn, logger, models.Movies)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	transport, err := openMailTransport(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	mailer, err := mailer.New(transport, cfg.smtp.sender)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	// Hot-reloading templates from disk is only allowed in development, where the
+	// templates directory is the source tree rather than the embedded copy
+	if cfg.mail.templatesDir != "" {
+		if cfg.env != "development" {
+			logger.Error("-mail-templates-dir can only be used in the development environment")
+			os.Exit(1)
+		}
+
+		err = mailer.ReloadFrom(cfg.mail.templatesDir)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("reloading mail templates from disk", "dir", cfg.mail.templatesDir)
+	}
+
+	// Close any open SMTP connections before main() exits
+	defer mailer.Close()
+
 	// Declare an instance of the application struct, containing the config struct, logger and others
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: models,
 		mailer: mailer,
+		jwt:    signer,
+		events: events,
+
+		passwordPolicy: passwordPolicy,
 	}
 
 	// Call app.serve() to start the server
@@ -125,6 +311,84 @@ func main() {
 	}
 }
 
+// Returns the JWT signer for the jwt auth mode, or nil in stateful mode
+func openJWT(cfg config) (*jwt.Signer, error) {
+	switch cfg.auth.mode {
+	case authModeStateful:
+		return nil, nil
+
+	case authModeJWT:
+		if cfg.auth.jwt.keys == "" {
+			return nil, errors.New("the jwt auth mode requires -jwt-keys to be set")
+		}
+
+		return jwt.New(cfg.auth.jwt.issuer, cfg.auth.jwt.audience, strings.Split(cfg.auth.jwt.keys, ","))
+
+	default:
+		return nil, errors.New("invalid -auth-mode, must be one of stateful|jwt")
+	}
+}
+
+// Returns the transport for delivering email. The file and memory transports need no SMTP
+// server, which makes them useful in development and testing
+func openMailTransport(cfg config) (mailer.Transport, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.poolSize)
+
+	case "file":
+		return mailer.NewFileTransport(cfg.mail.dir)
+
+	case "memory":
+		return mailer.NewMemoryTransport(), nil
+
+	default:
+		return nil, errors.New("invalid -mail-transport, must be one of smtp|file|memory")
+	}
+}
+
+// Sets the hasher used for new password hashes. Hashes made with any other supported
+// algorithm or cost are upgraded to this one when their user next logs in
+func setPasswordHasher(cfg config) error {
+	switch cfg.password.hasher {
+	case "bcrypt":
+		if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("invalid -bcrypt-cost, must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		data.SetPasswordHasher(data.BcryptHasher{Cost: cfg.password.bcryptCost})
+
+	case "argon2id":
+		data.SetPasswordHasher(data.DefaultArgon2idHasher)
+
+	default:
+		return errors.New("invalid -password-hasher, must be one of bcrypt|argon2id")
+	}
+
+	return nil
+}
+
+// Returns the password policy, loading the breached password list if one was configured.
+// The maximum length is fixed at 72 bytes, since bcrypt ignores anything beyond that
+func openPasswordPolicy(cfg config) (validator.PasswordPolicy, error) {
+	policy := validator.PasswordPolicy{
+		MinLength:  cfg.password.minLength,
+		MaxLength:  72,
+		MinEntropy: cfg.password.minEntropy,
+	}
+
+	if cfg.password.breachedFile != "" {
+		breached, err := validator.LoadBreachedPasswords(cfg.password.breachedFile)
+		if err != nil {
+			return policy, err
+		}
+
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
 // It returns a sql.DB connection pool
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
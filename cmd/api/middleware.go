@@ -1,15 +1,45 @@
 package main
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 )
 
+// Request IDs from upstream proxies are only reused if they look like an ID, so that they
+// can't inject anything into the logs or responses
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestID() gives each request an ID, which is logged with any errors and included in
+// problem details responses. An X-Request-ID header set by a proxy is kept, and otherwise
+// a random ID is generated. The ID is sent back in the X-Request-ID response header
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = rand.Text()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function that will always run in the event of panic
@@ -102,3 +132,519 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Add the "Vary: Authorization" header to the response. This indicates to any
+		// caches that the response may vary based on the value of the Authorization header
+		w.Header().Add("Vary", "Authorization")
+
+		// Retrieve the value of the Authorization header from the request. This will
+		// return the empty string "" if there is no such header found
+		authorizationHeader := r.Header.Get("Authorization")
+
+		// If there is no Authorization header found, use the contextSetUser() helper
+		// to add the AnonymousUser to the request context
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Otherwise, we expect the value of the Authorization header to be in the format
+		// "Bearer <token>" or "ApiKey <key>". We try to split this into its constituent
+		// parts, and if the header isn't in the expected format we return a 401 Unauthorized response
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		var (
+			user *data.User
+			err  error
+		)
+
+		switch headerParts[0] {
+		case "Bearer":
+			if app.config.auth.mode == authModeJWT {
+				user, err = app.authenticateJWT(headerParts[1])
+			} else {
+				user, err = app.authenticateToken(r, headerParts[1])
+			}
+
+		case "ApiKey":
+			var key *data.APIKey
+			key, user, err = app.authenticateAPIKey(headerParts[1])
+			if err == nil {
+				r = app.contextSetAPIKey(r, key)
+			}
+
+		default:
+			err = data.ErrRecordNotFound
+		}
+
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+
+			return
+		}
+
+		// Call the contextSetUser() helper to add the user information to the request context
+		r = app.contextSetUser(r, user)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Retrieves the user for a stateful authentication token, recording when and from where
+// the session was last used. An invalid or unknown token returns ErrRecordNotFound
+func (app *application) authenticateToken(r *http.Request, token string) (*data.User, error) {
+	// Validate the token to make sure it is in a sensible format
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, data.ErrRecordNotFound
+	}
+
+	// Retrieve the details of the user associated with the authentication token
+	user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session details are only informational, so failing to record them shouldn't
+	// fail the request
+	err = app.models.Tokens.Touch(data.ScopeAuthentication, token, app.readClient(r))
+	if err != nil {
+		app.logger.Error("unable to record session use", "user_id", user.ID, "error", err.Error())
+	}
+
+	return user, nil
+}
+
+// Retrieves the user for a signed JWT. The signature and claims are checked without
+// touching the database, which is then only used to load the user record itself
+func (app *application) authenticateJWT(token string) (*data.User, error) {
+	claims, err := app.jwt.Verify(token)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.models.Users.Get(id)
+}
+
+// Retrieves an API key and the user who owns it
+func (app *application) authenticateAPIKey(keyPlaintext string) (*data.APIKey, *data.User, error) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		return nil, nil, data.ErrRecordNotFound
+	}
+
+	return app.models.APIKeys.GetForKey(keyPlaintext)
+}
+
+// Checks that a user is not anonymous
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Checks that a user is both authenticated and activated
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	// Rather than returning this http.HandlerFunc we assign it to the variable fn
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		// If the user is not activated, use the inactiveAccountResponse() helper
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	// Wrap fn with the requireAuthenticatedUser() middleware before returning it
+	return app.requireAuthenticatedUser(fn)
+}
+
+// Checks that the request wasn't authenticated with an API key. API keys are limited to their
+// scopes, which only cover permission-checked routes, so routes which manage the user's own
+// account and credentials are closed to them. This goes inside requireAuthenticatedUser() or
+// requireActivatedUser(), so that anonymous requests are still told to authenticate
+func (app *application) requireNoAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Note that the first parameter for the middleware function is the permission code that
+// we require the user to have
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// Retrieve the user from the request context
+		user := app.contextGetUser(r)
+
+		// Get the slice of permissions for the user, limited to the API key's scopes
+		// if the request was authenticated with one
+		permissions, err := app.effectivePermissions(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Check if the slice includes the required permission. If it doesn't, then
+		// return a 403 Forbidden response
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	// Wrap this with the requireActivatedUser() middleware before returning it
+	return app.requireActivatedUser(fn)
+}
+
+// Returns the permissions which apply to the current request. For requests authenticated
+// with an API key, this is the intersection of the owner's permissions and the key's scopes
+func (app *application) effectivePermissions(r *http.Request, user *data.User) (data.Permissions, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	if key == nil {
+		return permissions, nil
+	}
+
+	var scoped data.Permissions
+
+	for _, code := range permissions {
+		if key.Scopes.Include(code) {
+			scoped = append(scoped, code)
+		}
+	}
+
+	return scoped, nil
+}
+
+// Cache-Control policies. Every response defaults to cacheNoStore so that user data never
+// ends up in a browser or shared cache, and routes serving public data opt in to publicCache()
+const cacheNoStore = "private, no-store"
+
+// publicCache() returns the policy for public reads, which CDNs and browsers may keep for
+// the configured max-age
+func (app *application) publicCache() string {
+	return fmt.Sprintf("public, max-age=%d", int(app.config.httpCache.maxAge.Seconds()))
+}
+
+// cacheControl() sets the Cache-Control header to the given policy before calling the next
+// handler, replacing any policy set further out in the chain
+func (app *application) cacheControl(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compressMinSize is the smallest response body worth compressing. Anything shorter fits in
+// a single packet anyway, and the gzip header and footer would only make it bigger
+const compressMinSize = 1024
+
+// compressor is implemented by both *gzip.Writer and *zlib.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compressors are pooled, since each one allocates several hundred kilobytes of state
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(io.Discard) }},
+	// Note that the HTTP "deflate" coding is the zlib format, not raw DEFLATE
+	"deflate": {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// Content types which are already compressed, and gain nothing from being compressed again
+var compressedContentTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+}
+
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Accept-Encoding header whether or not it ends up
+		// compressed, so caches must always key on it
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Values("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		next.ServeHTTP(cw, r)
+
+		// Note that this isn't deferred, so that if the handler panics recoverPanic() can
+		// still send its error response over the uncompressed writer
+		cw.Close()
+	})
+}
+
+// negotiateEncoding() returns the content coding to compress a response with, picking the
+// one with the highest quality value from the Accept-Encoding header, and preferring gzip
+// on a tie. It returns "" if the response should not be compressed
+func negotiateEncoding(header []string) string {
+	q := map[string]float64{}
+
+	for _, value := range header {
+		for part := range strings.SplitSeq(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+
+			weight := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+				weight = f
+			}
+
+			switch coding {
+			case "x-gzip":
+				coding = "gzip"
+			case "":
+				continue
+			}
+
+			q[coding] = weight
+		}
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		weight, ok := q[coding]
+		if !ok {
+			// A wildcard covers any coding not listed by name
+			weight = q["*"]
+		}
+
+		if weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether the response is
+// worth compressing, which is when the body reaches compressMinSize bytes, the handler
+// flushes, or the handler returns
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status      int
+	wroteHeader bool
+	started     bool
+	buf         []byte
+	cw          compressor
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.status = status
+	w.wroteHeader = true
+
+	// Responses which never have a body are sent straight away
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.start(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < compressMinSize {
+			return len(b), nil
+		}
+
+		err := w.start(true)
+		if err != nil {
+			return 0, err
+		}
+
+		return len(b), nil
+	}
+
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush() is used by streaming endpoints. A stream is compressed from its first flush
+// whatever its size, as more data is expected to follow
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.started {
+		w.start(true)
+	}
+
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer, for example to change
+// the write deadline
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// start() sends the response headers, compressing the body from here on if compress is true
+// and the content type is worth compressing, and then writes out anything buffered so far
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+
+	h := w.ResponseWriter.Header()
+
+	// Sniff the content type now, as the net/http package would otherwise sniff the
+	// compressed bytes
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+
+		w.cw = compressorPools[w.encoding].Get().(compressor)
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	buf := w.buf
+	w.buf = nil
+
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+// Close() sends anything still buffered, which is too short to be worth compressing, or
+// finishes the compressed stream and returns the compressor to its pool
+func (w *compressWriter) Close() {
+	if !w.started && w.wroteHeader {
+		w.start(false)
+	}
+
+	if w.cw != nil {
+		w.cw.Close()
+		compressorPools[w.encoding].Put(w.cw)
+		w.cw = nil
+	}
+}
+
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		return true
+	}
+
+	for _, prefix := range compressedContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decompressRequest() decompresses request bodies sent with Content-Encoding: gzip. The
+// size limit in readRequest() is applied afterwards, to the decompressed body, so a small
+// compressed body can't expand past it
+func (app *application) decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				app.badRequestResponse(w, r, errors.New("body is not valid gzip"))
+				return
+			}
+			defer zr.Close()
+
+			r.Body = zr
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+
+			next.ServeHTTP(w, r)
+
+		default:
+			app.unsupportedContentEncodingResponse(w, r)
+		}
+	})
+}
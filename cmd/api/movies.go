@@ -7,6 +7,7 @@ import (
 
 	"github.com/azizjon12/greenlight/internal/data"
 	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
 // Add a createMovieHandler for the "POST /v1/movies" endpoint
@@ -20,9 +21,9 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Genres  []string     `json:"genres"`
 	}
 
-	// Use the readJSON() helper to decode the request body into the input struct.
+	// Use the readRequest() helper to decode the request body into the input struct.
 	// If this returns an error, send the error message along with a 400 Bad Request code
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -36,19 +37,34 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Genres:  input.Genres,
 	}
 
+	// Record the authenticated user (if any) as the author of the movie
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		movie.UserID = user.ID
+	}
+
 	// Initialze a new Validator instance
 	v := validator.New()
 
 	// Call ValidateMovie() function, and if any checks fail, return a response witht the errors
 	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	// Call the Insert() method
+	// Call the Insert() method. A constraint violation which slipped past ValidateMovie()
+	// (such as a year check that disagrees with the database clock) is reported as a 422
 	err = app.models.Movies.Insert(movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		var constraintErr *data.ConstraintError
+
+		switch {
+		case errors.As(err, &constraintErr):
+			app.constraintViolationResponse(w, r, constraintErr)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
 		return
 	}
 
@@ -57,7 +73,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
 	// JSON response with a 201 Created code, the movie data in the response body and Location header
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -66,6 +82,17 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// fmt.Fprintf(w, "%+v\n", input)
 }
 
+// httprouter doesn't allow the static GET /v1/movies/stream route alongside the
+// /v1/movies/:id wildcard, so the stream is dispatched from the :id route instead
+func (app *application) showMovieOrStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") == "stream" {
+		app.streamMoviesHandler(w, r)
+		return
+	}
+
+	app.showMovieHandler(w, r)
+}
+
 // Add a showMovieHandler for the "GET /v1/movies/:id" endpoint
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
@@ -90,9 +117,14 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Create an envelope{"movie": movie} instance and pass it to writeJSON(),
+	// Send 304 Not Modified if the client already has this version of the movie
+	if app.notModified(w, r, movie.UpdatedAt) {
+		return
+	}
+
+	// Create an envelope{"movie": movie} instance and pass it to writeResponse(),
 	// instead of passing the plain movie struct
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, lastModifiedHeader(movie.UpdatedAt))
 	if err != nil {
 		// Using the new serverErrorResponse() helper
 		app.serverErrorResponse(w, r, err)
@@ -129,7 +161,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		Genres  []string      `json:"genres"`
 	}
 
-	err = app.readJSON(w, r, &input)
+	err = app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -159,7 +191,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	v := validator.New()
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -167,10 +199,15 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Pass the updated movie record to our new Update() method
 	err = app.models.Movies.Update(movie)
 	if err != nil {
+		var constraintErr *data.ConstraintError
+
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
+		case errors.Is(err, data.ErrEditConflict), errors.Is(err, data.ErrSerializationFailure):
 			app.editConflictResponse(w, r)
 
+		case errors.As(err, &constraintErr):
+			app.constraintViolationResponse(w, r, constraintErr)
+
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -178,7 +215,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Write the updated movie record in a JSON response
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -207,7 +244,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Return a 200 OK code along with a success message
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -240,7 +277,20 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 
 	// Execute the validation checks on the Filters struct and send a response containing the errors if necessary
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Any movie being created, updated or deleted changes the listing, so it was last modified
+	// at the latest of those changes. Read this before the movies so that a change made in
+	// between makes the Last-Modified time too old rather than too new
+	lastModified, err := app.models.Movies.LastModified()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.notModified(w, r, lastModified) {
 		return
 	}
 
@@ -252,7 +302,7 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Include the metadata in the response envelope
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, lastModifiedHeader(lastModified))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
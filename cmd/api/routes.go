@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -20,16 +21,77 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	// Add the route for the GET /v1/movies/ endpoint
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMovieHandler)
+	// Movie reads are public, so CDNs and browsers may cache them
+	router.Handler(http.MethodGet, "/v1/movies", app.cacheControl(app.publicCache(), http.HandlerFunc(app.listMovieHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
+	router.Handler(http.MethodGet, "/v1/movies/:id", app.cacheControl(app.publicCache(), http.HandlerFunc(app.showMovieOrStreamHandler)))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
 
+	// The change feed of movie events, read with long polling
+	router.HandlerFunc(http.MethodGet, "/v1/events", app.listEventsHandler)
+
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	// Add the route for the PUT /v1/users/activated endpoint
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
-	// Wrap the router with the rateLimit() middleware
-	return app.recoverPanic(app.rateLimit(router))
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	// Routes for the authenticated user to export or erase their own data. These and the other
+	// account and credential routes below can't be used with an API key
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticatedUser(app.requireNoAPIKey(app.exportUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.requireNoAPIKey(app.deleteUserHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireAuthenticatedUser(app.requireNoAPIKey(app.changeUserPasswordHandler)))
+
+	// Routes for listing and revoking the authenticated user's logged-in devices
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.requireNoAPIKey(app.listSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.requireNoAPIKey(app.deleteSessionHandler)))
+
+	// Add the route for the POST /v1/tokens/authentication endpoint
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.requireNoAPIKey(app.deleteAuthenticationTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+
+	// Routes for enrolling in, confirming and turning off two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireNoAPIKey(app.enrolTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.requireActivatedUser(app.requireNoAPIKey(app.verifyTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireNoAPIKey(app.disableTOTPHandler)))
+
+	// Routes for managing the API keys used by machine-to-machine clients
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireActivatedUser(app.requireNoAPIKey(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireActivatedUser(app.requireNoAPIKey(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireActivatedUser(app.requireNoAPIKey(app.deleteAPIKeyHandler)))
+
+	// Admin-only user management routes, all requiring the users:admin permission
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/activated", app.requirePermission("users:admin", app.updateUserActivatedHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.forceUserPasswordResetHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/tokens", app.requirePermission("users:admin", app.revokeUserTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/unlock", app.requirePermission("users:admin", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/emails", app.requirePermission("users:admin", app.listUserEmailsHandler))
+
+	// Admin-only email template preview routes
+	router.HandlerFunc(http.MethodGet, "/v1/admin/email-templates", app.requirePermission("users:admin", app.listEmailTemplatesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/email-templates/:name", app.requirePermission("users:admin", app.previewEmailTemplateHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/email-templates/:name/send", app.requirePermission("users:admin", app.sendTestEmailHandler))
+
+	// Admin-only webhook management routes
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks", app.requirePermission("users:admin", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/webhooks", app.requirePermission("users:admin", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/webhooks/:id", app.requirePermission("users:admin", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks/:id/deliveries", app.requirePermission("users:admin", app.listWebhookDeliveriesHandler))
+
+	// Application metrics, including the movie cache hit and miss counts. These reveal the
+	// command line the server was started with, so they are admin-only
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("users:admin", expvar.Handler().ServeHTTP))
+
+	// Wrap the router with the rateLimit() and authenticate() middleware, and make every
+	// response private and uncached unless its route sets another policy. Responses are
+	// compressed, and compressed request bodies decompressed, for everything inside recoverPanic().
+	// Request IDs are assigned first, so that even panics are logged with one
+	return app.requestID(app.recoverPanic(app.compress(app.rateLimit(app.decompressRequest(app.cacheControl(cacheNoStore, app.authenticate(router)))))))
 }
@@ -22,6 +22,19 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// Start the background job workers. They run until stopWorkers() is called during
+	// shutdown, then finish whatever job they have in hand
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	app.startWorkers(workerCtx)
+
+	// Relay change feed notifications to waiting requests. The broker is closed as soon as
+	// shutdown begins, which tells event streams and long polls to return, since Shutdown()
+	// would otherwise wait for them
+	app.wg.Go(app.events.run)
+	srv.RegisterOnShutdown(app.events.Close)
+
 	// Create a shutdownError channel. Will be used to receive any errors
 	// returned by graceful Shutdown() function
 	shutdownError := make(chan error)
@@ -45,6 +58,10 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		// Stop the job workers from claiming any new jobs. Jobs which are still queued stay
+		// in the database and are picked up again when the application restarts
+		stopWorkers()
+
 		// Log a message to say that we're waiting for any background goroutines to complete their tasks
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
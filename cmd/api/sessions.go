@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Flag the session belonging to the token used for this request
+	if token, ok := app.readBearerToken(r); ok {
+		currentID := data.SessionIDForPlaintext(token)
+
+		for _, session := range sessions {
+			session.Current = session.ID == currentID
+		}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessionID := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := app.models.Tokens.DeleteSession(user.ID, sessionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/jwt"
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the email and password from the request body
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Validate the email and password provided by the client
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// Every response below is held back until the same fixed time after the start, and
+	// every failure gets the same message, so that neither the response nor how long it
+	// takes reveals whether the email is registered, whether the account is locked, or
+	// whether the password was right
+	start := time.Now()
+	w = &deadlineWriter{ResponseWriter: w, deadline: start.Add(app.config.login.responseTime)}
+
+	// Lookup the user record based on the email address. If no matching user was found,
+	// we still check the password against a dummy hash to spend the same amount of time
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			data.SimulatePasswordMatch(input.Password)
+			app.invalidCredentialsResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	policy := app.loginPolicy()
+
+	// Check if the provided password matches the actual password for the user. This is
+	// done even if the account is locked or backing off, so that those cases take as long
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Count the attempt as a failure up front, which also tells us if the account is
+	// blocked. While it is, attempts are refused and not counted, whether or not the
+	// password was right
+	attempts, blocked, locked, err := app.models.Logins.Attempt(user.ID, start, policy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if blocked {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if !match {
+		// Let the user know their account was locked, in case it wasn't them
+		if locked {
+			err = app.enqueueEmail(user, "account_locked.tmpl", map[string]any{
+				"lockedUntil": attempts.LockedUntil,
+			}, nil)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// The password was right, so clear this and any earlier failures
+	err = app.models.Logins.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Now that we know the plaintext password, take the chance to re-hash it if it was
+	// hashed with an outdated algorithm or cost
+	app.upgradePasswordHash(user, input.Password)
+
+	// If the user has turned on two-factor authentication, the password alone isn't
+	// enough. Issue a short-lived challenge token which can only be exchanged for an
+	// authentication token along with a valid code
+	secret, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if secret != nil && secret.Enabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeResponse(w, r, http.StatusOK, envelope{"mfa_challenge_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Otherwise, if the password is correct, we start a new token family and issue the
+	// authentication and refresh tokens for it
+	app.issueTokenPair(w, r, user.ID, data.NewFamily())
+}
+
+// deadlineWriter holds back the start of a response until its deadline has passed
+type deadlineWriter struct {
+	http.ResponseWriter
+	deadline time.Time
+	waited   bool
+}
+
+func (w *deadlineWriter) wait() {
+	if !w.waited {
+		time.Sleep(time.Until(w.deadline))
+		w.waited = true
+	}
+}
+
+func (w *deadlineWriter) WriteHeader(status int) {
+	w.wait()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.wait()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Re-hashes a user's password with the current hasher if their stored hash is outdated.
+// Failing to do so isn't fatal to the login, since the old hash still works, so errors
+// are only logged
+func (app *application) upgradePasswordHash(user *data.User, plaintextPassword string) {
+	if !user.Password.NeedsUpgrade() {
+		return
+	}
+
+	err := user.Password.Set(plaintextPassword)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+
+	if err != nil {
+		app.logger.Error("unable to upgrade password hash", "user_id", user.ID, "error", err.Error())
+	}
+}
+
+// Returns the failed login throttling policy from the application config
+func (app *application) loginPolicy() data.LoginPolicy {
+	return data.LoginPolicy{
+		MaxAttempts: app.config.login.maxAttempts,
+		BackoffBase: app.config.login.backoffBase,
+		Lockout:     app.config.login.lockout,
+	}
+}
+
+// Generates a new authentication token with a 24-hour expiry time, along with a refresh
+// token which can be exchanged for the next pair, and sends both to the client
+func (app *application) issueTokenPair(w http.ResponseWriter, r *http.Request, userID int64, family []byte) {
+	client := app.readClient(r)
+
+	var (
+		authenticationToken *data.Token
+		err                 error
+	)
+
+	// In jwt mode the authentication token is a signed JWT rather than a database record.
+	// Its sid claim carries the token family, so that logging out can revoke the refresh token
+	if app.config.auth.mode == authModeJWT {
+		authenticationToken = &data.Token{UserID: userID, Scope: data.ScopeAuthentication}
+		authenticationToken.Plaintext, authenticationToken.Expiry, err = app.jwt.Sign(strconv.FormatInt(userID, 10), hex.EncodeToString(family), app.config.auth.jwt.ttl)
+	} else {
+		authenticationToken, err = app.models.Tokens.NewInFamily(userID, 24*time.Hour, data.ScopeAuthentication, family, client)
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshToken, err := app.models.Tokens.NewInFamily(userID, 30*24*time.Hour, data.ScopeRefresh, family, client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created status code
+	env := envelope{
+		"authentication_token": authenticationToken,
+		"refresh_token":        refreshToken,
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchanges a refresh token for a new authentication and refresh token pair. The old
+// refresh token is invalidated, and presenting it again revokes its whole family
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	token, err := app.models.Tokens.ClaimRefresh(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn("refresh token reused, token family revoked", "ip", realip.FromRequest(r))
+			app.invalidAuthenticationTokenResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	app.issueTokenPair(w, r, token.UserID, token.Family)
+}
+
+// Logs the user out by deleting the authentication token used for this request, along
+// with every other token issued from the same login
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := app.readBearerToken(r)
+	if !ok {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	var err error
+
+	// A JWT can't be revoked before it expires, but deleting its family stops the matching
+	// refresh token from issuing any more of them
+	if app.config.auth.mode == authModeJWT {
+		var claims *jwt.Claims
+
+		claims, err = app.jwt.Verify(token)
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		family, decodeErr := hex.DecodeString(claims.SessionID)
+		if decodeErr == nil && len(family) > 0 {
+			err = app.models.Tokens.DeleteFamily(family)
+		}
+	} else {
+		err = app.models.Tokens.DeleteWithFamily(data.ScopeAuthentication, token)
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "successfully logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadlineWriterHoldsResponse(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			start := time.Now()
+
+			rec := httptest.NewRecorder()
+			w := &deadlineWriter{ResponseWriter: rec, deadline: start.Add(delay)}
+
+			w.WriteHeader(status)
+			w.Write([]byte("{}"))
+
+			if elapsed := time.Since(start); elapsed < delay {
+				t.Errorf("response was written after %s; want at least %s", elapsed, delay)
+			}
+
+			if rec.Code != status || rec.Body.String() != "{}" {
+				t.Errorf("got %d %q; want %d %q", rec.Code, rec.Body, status, "{}")
+			}
+		})
+	}
+}
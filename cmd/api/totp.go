@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/totp"
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+// Starts enrolment by generating a new secret, which the user adds to their authenticator
+// app. Two-factor authentication isn't turned on until a code has been verified
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret := totp.GenerateSecret()
+
+	err := app.models.TOTP.SetPending(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddErrorCode("totp", validator.CodeAlreadyExists, "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	env := envelope{
+		"secret": secret,
+		"uri":    totp.URI("Greenlight", user.Email, secret),
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Completes enrolment. The code proves the authenticator app was set up correctly, after
+// which two-factor authentication is turned on and the recovery codes are returned
+func (app *application) verifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	secret, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "enrolment has not been started")
+			app.failedValidationResponse(w, r, v)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	if secret.Enabled {
+		v.AddErrorCode("totp", validator.CodeAlreadyExists, "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	step, ok := totp.Validate(input.Code, secret.Secret, time.Now(), secret.LastStep)
+	if !ok {
+		v.AddError("code", "invalid authentication code")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	codes, err := app.models.TOTP.Enable(user.ID, step)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turns off two-factor authentication. Both the password and a current code (or a
+// recovery code) are required, so a stolen session alone can't weaken the account
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchanges an MFA challenge token from the password step, plus a valid code, for an
+// authentication token
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAChallenge, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Wrong codes are subject to the same backoff and lockout as wrong passwords, so a
+	// challenge can't be used to guess codes freely. They have a counter of their own,
+	// which a correct password doesn't reset, so logging in again doesn't allow any more
+	// guesses. Once the second factor locks, the challenge is deleted
+	attempts, blocked, locked, err := app.models.MFAAttempts.Attempt(user.ID, time.Now(), app.loginPolicy())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if blocked {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		if locked {
+			err = app.models.Tokens.DeleteAllForUser(data.ScopeMFAChallenge, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			err = app.enqueueEmail(user, "account_locked.tmpl", map[string]any{
+				"lockedUntil": attempts.LockedUntil,
+			}, nil)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.MFAAttempts.Reset(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The challenge has been answered, so it can't be used again
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFAChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueTokenPair(w, r, user.ID, data.NewFamily())
+}
+
+// Checks a code against the user's enabled TOTP secret, falling back to their recovery
+// codes. Returns ErrRecordNotFound if two-factor authentication isn't enabled
+func (app *application) verifySecondFactor(userID int64, code string) (bool, error) {
+	secret, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !secret.Enabled {
+		return false, data.ErrRecordNotFound
+	}
+
+	step, ok := totp.Validate(code, secret.Secret, time.Now(), secret.LastStep)
+	if ok {
+		err = app.models.TOTP.RecordStep(userID, step)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return app.models.TOTP.UseRecoveryCode(userID, code)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/totp"
+)
+
+func TestMFAFailuresSurviveLogin(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.login.maxAttempts = 3
+	app.config.login.lockout = time.Hour
+
+	const password = "pa55word-correct-horse"
+
+	user := &data.User{
+		Name:      "Alice Smith",
+		Email:     fmt.Sprintf("alice-%d@example.com", time.Now().UnixNano()),
+		Locale:    "en",
+		Activated: true,
+	}
+
+	err := user.Password.Set(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.models.Users.Delete(user.ID) })
+
+	secret := totp.GenerateSecret()
+
+	err = app.models.TOTP.SetPending(user.ID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.models.TOTP.Enable(user.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login() answers the password step and returns the MFA challenge token
+	login := func() string {
+		t.Helper()
+
+		body := fmt.Sprintf(`{"email": %q, "password": %q}`, user.Email, password)
+
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		app.createAuthenticationTokenHandler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d from the password step; want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+
+		var resp struct {
+			Token struct {
+				Plaintext string `json:"token"`
+			} `json:"mfa_challenge_token"`
+		}
+
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Token.Plaintext
+	}
+
+	// answer() submits a code for a challenge and returns the response status
+	answer := func(challenge, code string) int {
+		t.Helper()
+
+		body := fmt.Sprintf(`{"token": %q, "code": %q}`, challenge, code)
+
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/mfa", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		app.createMFAAuthenticationTokenHandler(w, r)
+
+		return w.Code
+	}
+
+	// Use up all but one of the allowed failures, then log in again. The correct password
+	// mustn't give back the guesses which have been used
+	challenge := login()
+
+	for range app.config.login.maxAttempts - 1 {
+		if status := answer(challenge, "not-a-code"); status != http.StatusUnauthorized {
+			t.Fatalf("got status %d for a wrong code; want %d", status, http.StatusUnauthorized)
+		}
+	}
+
+	challenge = login()
+
+	if status := answer(challenge, "not-a-code"); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d for a wrong code; want %d", status, http.StatusUnauthorized)
+	}
+
+	// That was the last allowed failure, so even the right code is now refused
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge = login()
+
+	if status := answer(challenge, code); status != http.StatusUnauthorized {
+		t.Errorf("got status %d for the right code after the lockout; want %d", status, http.StatusUnauthorized)
+	}
+}
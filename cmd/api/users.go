@@ -15,10 +15,11 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 
 	// Parse the request body into the anonymous struct
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -28,6 +29,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
+		Locale:    app.readLocale(r, input.Locale),
 		Activated: false,
 	}
 
@@ -40,9 +42,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
+	// Check the password against the password policy first, so that every violation is
+	// reported rather than only the basic length check made by ValidateUser()
+	app.passwordPolicy.Validate(v, input.Password, input.Name, input.Email)
+
 	// Validate the user struct and return the error message to the client if any checks fail
 	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -50,12 +56,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	err = app.models.Users.Insert(user)
 	if err != nil {
 		switch {
-		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
+		// If we get a ErrDuplicateEmail error, use the v.AddErrorCode() method to manually
 		// add a message to the validator instance, and then call our
 		// failedValidationResponse() helper.
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
+			v.AddErrorCode("email", validator.CodeAlreadyExists, "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v)
 
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -65,30 +71,32 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// After the user record has been created in the database, generate a new activation token for the user
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	activationTTL := 3 * 24 * time.Hour
+
+	token, err := app.models.Tokens.New(user.ID, activationTTL, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Use the background helper to execute an anonymous function that sends the welcome email
-	app.background(func() {
-		// Create a map to act as a 'holding structure' for the data
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Send the welcome email, passing in the map above as dynamic data
-		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
+	// Queue the welcome email, passing in a map to act as a 'holding structure' for the
+	// dynamic data. The job workers send it, retrying if the SMTP server is unavailable.
+	// The token is passed as a secret, so it isn't kept in the queue if sending fails for good
+	err = app.enqueueEmail(user, "user_welcome.tmpl", map[string]any{
+		"activationTTL": activationTTL.String(),
+		"name":          user.Name,
+		"userID":        user.ID,
+	}, map[string]any{
+		"activationToken": token.Plaintext,
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Note we also change this to send the client a 202 Accepted status code. Meaning
 	// request has been accepted for processing but not the processing has not yet been completed
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -100,7 +108,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		TokenPlaintext string `json:"token"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -110,7 +118,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 
 	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -119,8 +127,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.Errors)
+			v.AddErrorCode("token", validator.CodeExpired, "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v)
 
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -129,11 +137,9 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Update the user's activation status
-	user.Activated = true
-
-	// Save the updated user record in our database, checking for any edit conflicts
-	err = app.models.Users.Update(user)
+	// Update the user's activation status, checking for any edit conflicts. The
+	// user.activated webhook deliveries are queued along with it
+	err = app.models.Users.Activate(user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -154,7 +160,243 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Send the updated user details to the client in a JSON response
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Returns a JSON archive of everything we hold about the authenticated user: their
+// profile, the metadata of their active tokens, their permissions and their movies
+func (app *application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Make sure the permissions are encoded as an empty JSON array rather than null
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	movies, err := app.models.Movies.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"user":        user,
+		"tokens":      tokens,
+		"permissions": permissions,
+		"movies":      movies,
+		"exported_at": time.Now().UTC(),
+	}
+
+	// Suggest a filename so that browsers save the archive rather than display it
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", `attachment; filename="greenlight-export.json"`)
+
+	err = app.writeResponse(w, r, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Erases the authenticated user's account after confirming their password. Tokens and
+// permissions are cascaded by the database, and authored movies are anonymised
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Require the password again, so that a stolen token alone can't erase an account
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Users.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "user account successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Sets a new password for the user holding a valid password reset token
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrorCode("token", validator.CodeExpired, "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Now that we know who the user is, check the new password against the password policy
+	if app.passwordPolicy.Validate(v, input.Password, user.Name, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// If the password update was successful, delete all password reset tokens for the user
+	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Changes the authenticated user's password, after confirming their current one
+func (app *application) changeUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	v.CheckCode(input.CurrentPassword != "", "current_password", validator.CodeRequired, "must be provided")
+	v.Check(input.CurrentPassword != input.Password, "password", "must be different from your current password")
+	app.passwordPolicy.Validate(v, input.Password, user.Name, user.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your password was successfully changed"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
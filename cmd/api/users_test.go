@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/mailer"
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+// newTestDB() connects to the database named by GREENLIGHT_TEST_DB_DSN, which must have
+// had the migrations applied. Tests which need a database are skipped when it isn't set
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newTestApplication() returns an application backed by the test database, which sends
+// its email to the returned MemoryTransport
+func newTestApplication(t *testing.T) (*application, *mailer.MemoryTransport) {
+	t.Helper()
+
+	transport := mailer.NewMemoryTransport()
+
+	m, err := mailer.New(transport, "Greenlight <no-reply@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.jobs.maxAttempts = 3
+	cfg.jobs.backoff = time.Second
+
+	models := data.NewModels(newTestDB(t))
+	models.Movies.DeliveryAttempts = cfg.jobs.maxAttempts
+	models.Users.DeliveryAttempts = cfg.jobs.maxAttempts
+
+	app := &application{
+		config: cfg,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models: models,
+		mailer: m,
+
+		passwordPolicy: validator.PasswordPolicy{MinLength: 8, MaxLength: 72},
+	}
+
+	return app, transport
+}
+
+var activationTokenRX = regexp.MustCompile(`"token": "([A-Z0-9]{26})"`)
+
+func TestRegisterUserSendsActivationToken(t *testing.T) {
+	app, transport := newTestApplication(t)
+
+	email := fmt.Sprintf("alice-%d@example.com", time.Now().UnixNano())
+	body := fmt.Sprintf(`{"name": "Alice Smith", "email": %q, "password": "pa55word-correct-horse"}`, email)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	app.registerUserHandler(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.models.Users.Delete(user.ID) })
+
+	// Nothing is sent until a worker runs the job. Other tests' jobs may be queued ahead
+	// of ours, so keep running jobs until the email turns up or the queue is empty
+	var msg *mailer.Message
+
+	for msg == nil && app.runNextJob(context.Background()) {
+		for _, m := range transport.Messages() {
+			if m.To == email {
+				msg = &m
+			}
+		}
+	}
+
+	if msg == nil {
+		t.Fatal("no welcome email was sent")
+	}
+
+	matches := activationTokenRX.FindStringSubmatch(msg.PlainBody)
+	if matches == nil {
+		t.Fatalf("welcome email has no activation token:\n%s", msg.PlainBody)
+	}
+
+	activated, err := app.models.Users.GetForToken(data.ScopeActivation, matches[1])
+	if err != nil {
+		t.Fatalf("activation token from the email was not accepted: %v", err)
+	}
+
+	if activated.ID != user.ID {
+		t.Errorf("activation token is for user %d; want %d", activated.ID, user.ID)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+// The HTTP client used to deliver webhooks. Redirects aren't followed, so that a delivery
+// only ever goes to the URL which was registered. ValidateWebhook() rejects URLs naming a
+// private address, but a hostname can resolve to one, so the address actually dialled is
+// checked as well
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+
+				addr, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+
+				if data.PrivateAddress(addr) {
+					return fmt.Errorf("%w: webhook address %s is not public", errPermanentJob, addr)
+				}
+
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// The payload for a deliver_webhook job
+type webhookJob struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+// deliverWebhook() POSTs an event to a webhook, recording the outcome in the delivery log
+func (app *application) deliverWebhook(job *data.Job, deliveryID int64) error {
+	delivery, webhook, err := app.models.Deliveries.Get(deliveryID)
+	if err != nil {
+		// The webhook (and so its deliveries) has been deleted, so there's nothing to do
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	responseStatus, err := postWebhook(webhookClient, webhook, delivery, time.Now())
+
+	final := errors.Is(err, errPermanentJob) || job.Attempts >= job.MaxAttempts
+
+	recordErr := app.models.Deliveries.RecordAttempt(delivery.ID, responseStatus, err, final)
+	if recordErr != nil {
+		app.logger.Error("unable to record webhook delivery", "delivery_id", delivery.ID, "error", recordErr.Error())
+	}
+
+	return err
+}
+
+// postWebhook() sends a delivery to its webhook, returning the response status (or zero
+// if there was no response). The request body is a JSON object holding the delivery ID,
+// event name, creation time and event data. It is signed with HMAC-SHA256 using the
+// webhook's secret, and the signature is sent in the X-Greenlight-Signature header as
+// "t=<unix time>,v1=<hex signature>", where the signed message is the timestamp, a full
+// stop, and the raw request body. Any response other than a 2xx is an error, and a 410
+// Gone is a permanent one
+func postWebhook(client *http.Client, webhook *data.Webhook, delivery *data.WebhookDelivery, now time.Time) (int, error) {
+	body, err := json.Marshal(map[string]any{
+		"id":         delivery.ID,
+		"event":      delivery.Event,
+		"created_at": delivery.CreatedAt,
+		"data":       delivery.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/"+version)
+	req.Header.Set("X-Greenlight-Event", delivery.Event)
+	req.Header.Set("X-Greenlight-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Greenlight-Signature", "t="+timestamp+",v1="+signWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drain (some of) the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, nil
+
+	// A 410 Gone response means the receiver has gone away for good
+	case resp.StatusCode == http.StatusGone:
+		return resp.StatusCode, fmt.Errorf("%w: webhook responded with status %d", errPermanentJob, resp.StatusCode)
+
+	default:
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+}
+
+// Returns the hex-encoded HMAC-SHA256 signature of a webhook delivery
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Registers a new webhook. If no secret is given then one is generated; either way it is
+// only included in this response
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+	}
+
+	if webhook.Secret == "" {
+		webhook.Secret = data.NewWebhookSecret()
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/webhooks/%d", webhook.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Returns the delivery log for a webhook
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	deliveries, err := app.models.Deliveries.GetAllForWebhook(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
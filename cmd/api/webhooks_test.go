@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/data"
+)
+
+// webhookReceiver is a test webhook endpoint which records each request it is sent, and
+// answers with the next of its statuses (repeating the last one when they run out)
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.requests = append(rcv.requests, receivedWebhook{header: r.Header.Clone(), body: body})
+
+	status := rcv.statuses[min(len(rcv.requests), len(rcv.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func newTestDelivery(t *testing.T, statuses ...int) (*webhookReceiver, *data.Webhook, *data.WebhookDelivery) {
+	t.Helper()
+
+	rcv := &webhookReceiver{statuses: statuses}
+
+	srv := httptest.NewServer(rcv)
+	t.Cleanup(srv.Close)
+
+	webhook := &data.Webhook{ID: 1, URL: srv.URL + "/hooks", Secret: "whsec_0123456789abcdef"}
+
+	delivery := &data.WebhookDelivery{
+		ID:        42,
+		CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		WebhookID: webhook.ID,
+		Event:     data.EventMovieCreated,
+		Payload:   json.RawMessage(`{"id":7,"title":"Moana"}`),
+	}
+
+	return rcv, webhook, delivery
+}
+
+func TestPostWebhookSignsDelivery(t *testing.T) {
+	rcv, webhook, delivery := newTestDelivery(t, http.StatusNoContent)
+
+	now := time.Unix(1_700_000_000, 0)
+
+	status, err := postWebhook(http.DefaultClient, webhook, delivery, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusNoContent {
+		t.Errorf("got status %d; want %d", status, http.StatusNoContent)
+	}
+
+	if len(rcv.requests) != 1 {
+		t.Fatalf("receiver got %d requests; want 1", len(rcv.requests))
+	}
+
+	req := rcv.requests[0]
+
+	if got := req.header.Get("X-Greenlight-Event"); got != delivery.Event {
+		t.Errorf("got X-Greenlight-Event %q; want %q", got, delivery.Event)
+	}
+
+	if got := req.header.Get("X-Greenlight-Delivery"); got != "42" {
+		t.Errorf("got X-Greenlight-Delivery %q; want %q", got, "42")
+	}
+
+	// Check the signature the way a receiver would, recomputing it from the raw body
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	want := "t=" + timestamp + ",v1=" + signWebhook(webhook.Secret, timestamp, req.body)
+
+	if got := req.header.Get("X-Greenlight-Signature"); got != want {
+		t.Errorf("got X-Greenlight-Signature %q; want %q", got, want)
+	}
+
+	var body struct {
+		ID    int64           `json:"id"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+
+	err = json.Unmarshal(req.body, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.ID != delivery.ID || body.Event != delivery.Event || string(body.Data) != string(delivery.Payload) {
+		t.Errorf("got body %s; want the delivery's ID, event and payload", req.body)
+	}
+}
+
+func TestPostWebhookRetriesServerErrors(t *testing.T) {
+	rcv, webhook, delivery := newTestDelivery(t, http.StatusServiceUnavailable, http.StatusOK)
+
+	status, err := postWebhook(http.DefaultClient, webhook, delivery, time.Now())
+	if err == nil {
+		t.Fatal("got no error for a 503 response")
+	}
+
+	if errors.Is(err, errPermanentJob) {
+		t.Fatalf("a 503 response should be retried, got permanent error: %v", err)
+	}
+
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// The retry is signed afresh and succeeds
+	status, err = postWebhook(http.DefaultClient, webhook, delivery, time.Now())
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("got status %d; want %d", status, http.StatusOK)
+	}
+
+	if len(rcv.requests) != 2 {
+		t.Errorf("receiver got %d requests; want 2", len(rcv.requests))
+	}
+}
+
+func TestPostWebhookGoneIsPermanent(t *testing.T) {
+	_, webhook, delivery := newTestDelivery(t, http.StatusGone)
+
+	status, err := postWebhook(http.DefaultClient, webhook, delivery, time.Now())
+	if !errors.Is(err, errPermanentJob) {
+		t.Fatalf("got error %v; want a permanent job error", err)
+	}
+
+	if status != http.StatusGone {
+		t.Errorf("got status %d; want %d", status, http.StatusGone)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	rcv, webhook, delivery := newTestDelivery(t, http.StatusOK)
+
+	// The test server listens on loopback, which the real client must refuse to dial
+	_, err := postWebhook(webhookClient, webhook, delivery, time.Now())
+	if !errors.Is(err, errPermanentJob) {
+		t.Fatalf("got error %v; want a permanent job error", err)
+	}
+
+	if len(rcv.requests) != 0 {
+		t.Errorf("receiver got %d requests; want none", len(rcv.requests))
+	}
+}
@@ -3,11 +3,13 @@ module github.com/azizjon12/greenlight
 go 1.25.5
 
 require (
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce // indirect
-	github.com/wneessen/go-mail v0.7.2 // indirect
-	golang.org/x/crypto v0.47.0 // indirect
-	golang.org/x/text v0.33.0 // indirect
-	golang.org/x/time v0.14.0 // indirect
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
+	github.com/wneessen/go-mail v0.7.2
+	golang.org/x/crypto v0.47.0
+	golang.org/x/text v0.33.0
+	golang.org/x/time v0.14.0
 )
+
+require golang.org/x/sys v0.40.0 // indirect
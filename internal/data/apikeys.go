@@ -0,0 +1,224 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// All API keys start with this prefix, which makes them easy to tell apart from tokens
+// (and easy to spot if one is accidentally committed somewhere)
+const APIKeyPrefix = "glk_"
+
+// Define an APIKey struct to hold the data for a machine-to-machine API key. The
+// plaintext is only ever populated straight after the key has been created
+type APIKey struct {
+	ID         int64       `json:"id"`
+	CreatedAt  time.Time   `json:"created_at"`
+	Name       string      `json:"name"`
+	Plaintext  string      `json:"key,omitzero"`
+	Hash       []byte      `json:"-"`
+	UserID     int64       `json:"-"`
+	Scopes     Permissions `json:"scopes"`
+	Expiry     *time.Time  `json:"expiry"`
+	LastUsedAt *time.Time  `json:"last_used_at"`
+}
+
+// Generates a new API key, hashing the plaintext with SHA-256 in the same way as tokens
+func generateAPIKey(userID int64, name string, scopes Permissions, expiry *time.Time) *APIKey {
+	key := &APIKey{
+		Name:      name,
+		Plaintext: APIKeyPrefix + rand.Text(),
+		UserID:    userID,
+		Scopes:    scopes,
+		Expiry:    expiry,
+	}
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.CheckCode(key.Name != "", "name", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(key.Name) <= 100, "name", validator.CodeTooLong, "must not be more than 100 bytes long")
+
+	v.CheckCode(len(key.Scopes) >= 1, "scopes", validator.CodeTooFew, "must contain at least 1 scope")
+	v.CheckCode(validator.Unique(key.Scopes), "scopes", validator.CodeDuplicate, "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext API key has been provided and looks like one of ours
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, APIKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(APIKeyPrefix)+26, "key", "must be a valid API key")
+}
+
+// Define the APIKeyModel type
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Shortcut which generates a new API key and then inserts it in the api_keys table
+func (m APIKeyModel) New(userID int64, name string, scopes Permissions, expiry *time.Time) (*APIKey, error) {
+	key := generateAPIKey(userID, name, scopes, expiry)
+
+	err := m.Insert(key)
+	return key, err
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (hash, user_id, name, scopes, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []any{key.Hash, key.UserID, key.Name, pq.Array(key.Scopes), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	return translateError(err)
+}
+
+// Returns all API keys (including expired ones) for a specific user
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, name, scopes, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.Name,
+			pq.Array(&key.Scopes),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Retrieves an unexpired API key and the user who owns it, recording that the key has
+// just been used
+func (m APIKeyModel) GetForKey(keyPlaintext string) (*APIKey, *User, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		FROM users
+		WHERE api_keys.user_id = users.id
+		AND api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+		RETURNING api_keys.id, api_keys.created_at, api_keys.name, api_keys.scopes, api_keys.expiry, api_keys.last_used_at,
+			users.id, users.created_at, users.name, users.email, users.locale, users.password_hash, users.activated, users.version`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		pq.Array(&key.Scopes),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	return &key, &user, nil
+}
+
+// Deletes (revokes) a specific API key belonging to a specific user
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is a key-value store for the results of read queries. Implementations must be
+// safe for concurrent use. Values are shared between callers, so they must be treated as
+// read-only.
+//
+// A value loaded from the database can be overtaken by a write which commits and
+// invalidates the cache before the value is stored, leaving the old value cached. To
+// prevent this, a caller reads the Generation() before it queries the database and passes
+// it to Set(), which discards the value if there has been an invalidation since.
+//
+// Keys don't include a version, because a lookup by ID can't know the version it's
+// looking for. Invalidating by key is enough: every write deletes the key after it commits,
+// the generation check stops an older value being stored afterwards, and the other
+// instances delete it when they receive the write's NOTIFY. If a notification is lost, the
+// listener reconnects and the whole cache is cleared, and the TTL bounds how long an entry
+// can be stale in the meantime
+type Cache interface {
+	Get(key string) (any, bool)
+	Generation() uint64
+	Set(key string, value any, generation uint64)
+	Delete(key string)
+	DeletePrefix(prefix string)
+	Clear()
+	Stats() CacheStats
+}
+
+// CacheStats holds counters describing how well a cache is performing
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+}
+
+// LRUCache is an in-process Cache which holds up to a fixed number of entries, each for a
+// limited time. When it is full, the least recently used entry is evicted to make room
+type LRUCache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // Most recently used at the front
+	generation uint64     // Incremented by every Delete(), DeletePrefix() and Clear()
+	now        func() time.Time
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type lruEntry struct {
+	key     string
+	value   any
+	expires time.Time
+}
+
+// NewLRUCache() returns an empty LRUCache. Entries expire after ttl, which bounds how long
+// a stale value can be served if an invalidation is ever missed
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+func (c *LRUCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+
+	if c.now().After(entry.expires) {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	c.hits.Add(1)
+
+	return entry.value, true
+}
+
+func (c *LRUCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+func (c *LRUCache) Set(key string, value any, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The value was loaded before the last invalidation, so it may be stale
+	if generation != c.generation {
+		return
+	}
+
+	expires := c.now().Add(c.ttl)
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// DeletePrefix() removes every entry whose key starts with prefix
+func (c *LRUCache) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *LRUCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   entries,
+	}
+}
+
+// remove() deletes an entry. The caller must hold the lock
+func (c *LRUCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).key)
+}
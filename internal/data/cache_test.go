@@ -0,0 +1,149 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// set() stores a value in the cache, as a caller which saw no invalidation would
+func set(c *LRUCache, key string, value any) {
+	c.Set(key, value, c.Generation())
+}
+
+func assertCached(t *testing.T, c *LRUCache, key string, want any) {
+	t.Helper()
+
+	got, ok := c.Get(key)
+	if !ok {
+		t.Errorf("%q is not cached; want %v", key, want)
+		return
+	}
+
+	if got != want {
+		t.Errorf("%q is cached as %v; want %v", key, got, want)
+	}
+}
+
+func assertNotCached(t *testing.T, c *LRUCache, key string) {
+	t.Helper()
+
+	if got, ok := c.Get(key); ok {
+		t.Errorf("%q is cached as %v; want it missing", key, got)
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(3, time.Hour)
+
+	set(c, "a", 1)
+	set(c, "b", 2)
+	set(c, "c", 3)
+
+	// Using a makes b the least recently used entry, so it goes first
+	c.Get("a")
+	set(c, "d", 4)
+
+	assertNotCached(t, c, "b")
+	assertCached(t, c, "a", 1)
+	assertCached(t, c, "c", 3)
+	assertCached(t, c, "d", 4)
+
+	// Updating an entry counts as using it. The order is now c, d, a, so c goes next
+	set(c, "a", 10)
+	c.Get("d")
+	set(c, "e", 5)
+
+	assertNotCached(t, c, "c")
+	assertCached(t, c, "a", 10)
+	assertCached(t, c, "d", 4)
+	assertCached(t, c, "e", 5)
+
+	stats := c.Stats()
+	if stats.Evictions != 2 {
+		t.Errorf("got %d evictions; want 2", stats.Evictions)
+	}
+
+	if stats.Entries != 3 {
+		t.Errorf("got %d entries; want 3", stats.Entries)
+	}
+}
+
+func TestLRUCacheExpiresEntries(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := NewLRUCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	set(c, "a", 1)
+
+	now = now.Add(30 * time.Second)
+	set(c, "b", 2)
+	assertCached(t, c, "a", 1)
+
+	// Reading an entry doesn't extend its life, but updating it does
+	now = now.Add(31 * time.Second)
+	assertNotCached(t, c, "a")
+	assertCached(t, c, "b", 2)
+
+	set(c, "b", 3)
+
+	now = now.Add(59 * time.Second)
+	assertCached(t, c, "b", 3)
+
+	now = now.Add(2 * time.Second)
+	assertNotCached(t, c, "b")
+
+	if entries := c.Stats().Entries; entries != 0 {
+		t.Errorf("got %d entries; want expired entries removed", entries)
+	}
+}
+
+func TestLRUCacheDeletePrefix(t *testing.T) {
+	c := NewLRUCache(10, time.Hour)
+
+	set(c, "movie:1", 1)
+	set(c, "movies:abc", 2)
+	set(c, "movies:def", 3)
+	set(c, "movies:last-modified", 4)
+
+	c.DeletePrefix("movies:")
+
+	assertCached(t, c, "movie:1", 1)
+	assertNotCached(t, c, "movies:abc")
+	assertNotCached(t, c, "movies:def")
+	assertNotCached(t, c, "movies:last-modified")
+
+	// Entries under the prefix can be cached again afterwards
+	set(c, "movies:ghi", 5)
+	assertCached(t, c, "movies:ghi", 5)
+
+	if entries := c.Stats().Entries; entries != 2 {
+		t.Errorf("got %d entries; want 2", entries)
+	}
+}
+
+func TestLRUCacheDropsValuesLoadedBeforeInvalidation(t *testing.T) {
+	invalidations := map[string]func(c *LRUCache){
+		"Delete":       func(c *LRUCache) { c.Delete("movie:1") },
+		"DeletePrefix": func(c *LRUCache) { c.DeletePrefix("movies:") },
+		"Clear":        func(c *LRUCache) { c.Clear() },
+	}
+
+	for name, invalidate := range invalidations {
+		t.Run(name, func(t *testing.T) {
+			c := NewLRUCache(10, time.Hour)
+
+			// A reader misses and starts loading the old value. Meanwhile a writer
+			// commits and invalidates, then the reader tries to store what it loaded
+			generation := c.Generation()
+			invalidate(c)
+			c.Set("movie:1", "stale", generation)
+
+			assertNotCached(t, c, "movie:1")
+
+			// A reader which started after the invalidation can store its value
+			set(c, "movie:1", "fresh")
+			assertCached(t, c, "movie:1", "fresh")
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Domain errors for the classes of PostgreSQL error we care about. A ConstraintError
+// wraps one of the first three, so callers can match on them with errors.Is()
+var (
+	ErrUniqueViolation      = errors.New("unique violation")
+	ErrCheckViolation       = errors.New("check violation")
+	ErrForeignKeyViolation  = errors.New("foreign key violation")
+	ErrSerializationFailure = errors.New("serialization failure")
+	ErrQueryCanceled        = errors.New("query canceled")
+)
+
+// ConstraintError reports which constraint a write violated and, where the constraint
+// maps onto a single input field, which field that was and why, with the validation code
+// for the error
+type ConstraintError struct {
+	Kind       error
+	Constraint string
+	Field      string
+	Code       string
+	Message    string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Constraint)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Kind
+}
+
+// The input field, validation code and message to report for each constraint which maps
+// onto a field
+var constraintFields = map[string]struct {
+	field   string
+	code    string
+	message string
+}{
+	"users_email_key":      {"email", validator.CodeAlreadyExists, "a user with this email address already exists"},
+	"movies_year_check":    {"year", validator.CodeInvalid, "must be between 1888 and the current year"},
+	"movies_runtime_check": {"runtime", validator.CodeTooSmall, "must not be negative"},
+	"genres_length_check":  {"genres", validator.CodeInvalid, "must contain between 1 and 5 genres"},
+}
+
+// translateError() maps *pq.Error values onto our domain errors using their SQLSTATE
+// codes, rather than matching on the driver's message text. Any other error is returned
+// unchanged
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	var kind error
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		kind = ErrUniqueViolation
+	case "check_violation":
+		kind = ErrCheckViolation
+	case "foreign_key_violation":
+		kind = ErrForeignKeyViolation
+	case "serialization_failure", "deadlock_detected":
+		return fmt.Errorf("%w: %s", ErrSerializationFailure, pqErr.Message)
+	case "query_canceled":
+		return fmt.Errorf("%w: %s", ErrQueryCanceled, pqErr.Message)
+	default:
+		return err
+	}
+
+	constraintErr := &ConstraintError{Kind: kind, Constraint: pqErr.Constraint}
+
+	if f, ok := constraintFields[pqErr.Constraint]; ok {
+		constraintErr.Field = f.field
+		constraintErr.Code = f.code
+		constraintErr.Message = f.message
+	}
+
+	return constraintErr
+}
+
+// isConstraint() reports whether err is a ConstraintError for a specific constraint
+func isConstraint(err error, constraint string) bool {
+	var constraintErr *ConstraintError
+	return errors.As(err, &constraintErr) && constraintErr.Constraint == constraint
+}
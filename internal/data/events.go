@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The key of the transaction-level advisory lock taken before an event is written. Holding
+// it until commit means events are committed in the same order as their IDs are assigned,
+// so a reader which has seen event N can never later find an uncommitted event below N
+const eventsLockKey = 7_341_001
+
+// The PostgreSQL notification channel which is notified, with the new event ID, whenever an
+// event is committed. Any number of application instances can LISTEN on it
+const EventsChannel = "events"
+
+// Define an Event struct to hold a single entry in the change feed. The payload holds the
+// entity as it was after the change (or just its ID, for deletions)
+type Event struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Type      string          `json:"type"`
+	EntityID  int64           `json:"entity_id"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// insertEvent() appends an event to the change feed as part of tx, so that the event is
+// recorded if and only if the change itself is committed. PostgreSQL holds back the
+// notification to listeners until the commit as well
+func insertEvent(ctx context.Context, tx *sql.Tx, eventType string, entityID int64, payload any) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, eventsLockKey)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		WITH event AS (
+			INSERT INTO events (type, entity_id, payload)
+			VALUES ($1, $2, $3)
+			RETURNING id
+		)
+		SELECT pg_notify($4, id::text) FROM event`
+
+	_, err = tx.ExecContext(ctx, query, eventType, entityID, []byte(js), EventsChannel)
+	return err
+}
+
+// Define the EventModel type
+type EventModel struct {
+	DB *sql.DB
+}
+
+// LatestID() returns the ID of the most recent event, or zero if there are none
+func (m EventModel) LatestID(ctx context.Context) (int64, error) {
+	query := `
+		SELECT COALESCE(MAX(id), 0)
+		FROM events`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&id)
+	return id, err
+}
+
+// GetAfter() returns up to limit events with an ID greater than after, in order
+func (m EventModel) GetAfter(ctx context.Context, after int64, limit int) ([]*Event, error) {
+	query := `
+		SELECT id, created_at, type, entity_id, payload
+		FROM events
+		WHERE id > $1
+		ORDER BY id ASC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+
+	for rows.Next() {
+		var event Event
+
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.Type,
+			&event.EntityID,
+			&event.Payload,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
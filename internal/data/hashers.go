@@ -0,0 +1,191 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher is implemented by each supported password hashing algorithm. Hashes are
+// stored in a self-describing format (the "$2a$..." format for bcrypt and the PHC string
+// format for argon2id), so that the algorithm and parameters can be read back from the
+// hash itself and old hashes keep working after the configuration changes
+type PasswordHasher interface {
+	// Hash returns a new self-describing hash of the plaintext password
+	Hash(plaintext string) ([]byte, error)
+	// Handles reports whether the hash was produced by this algorithm
+	Handles(hash []byte) bool
+	// Matches reports whether the plaintext matches a hash produced by this algorithm,
+	// whatever parameters it was produced with
+	Matches(hash []byte, plaintext string) (bool, error)
+	// NeedsRehash reports whether a hash produced by this algorithm uses different
+	// parameters from the hasher's own
+	NeedsRehash(hash []byte) bool
+}
+
+// The hasher used for new passwords, and the hashers used to check existing ones. The
+// current hasher is always tried first, so its parameters don't affect verification
+var (
+	currentHasher PasswordHasher = BcryptHasher{Cost: 12}
+	knownHashers                 = []PasswordHasher{BcryptHasher{Cost: 12}, DefaultArgon2idHasher}
+)
+
+// SetPasswordHasher() changes the hasher used for new passwords. Existing hashes made by
+// any supported algorithm still match, and are upgraded when the user next logs in. It
+// should only be called at startup, before any requests are served
+func SetPasswordHasher(h PasswordHasher) {
+	currentHasher = h
+}
+
+// Returns the hasher able to check a specific hash
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	if currentHasher.Handles(hash) {
+		return currentHasher, nil
+	}
+
+	for _, h := range knownHashers {
+		if h.Handles(hash) {
+			return h, nil
+		}
+	}
+
+	return nil, ErrUnknownHashFormat
+}
+
+// BcryptHasher hashes passwords with bcrypt at a specific cost
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) Handles(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2"))
+}
+
+func (h BcryptHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id. Memory is in KiB
+type Argon2idHasher struct {
+	Time        uint32
+	Memory      uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idHasher uses the second recommended option from RFC 9106 (3 passes over
+// 64 MiB of memory)
+var DefaultArgon2idHasher = Argon2idHasher{
+	Time:        3,
+	Memory:      64 * 1024,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	rand.Read(salt)
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Time, h.Memory, h.Parallelism, h.KeyLength)
+
+	enc := base64.RawStdEncoding
+	hash := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		h.Memory, h.Time, h.Parallelism, enc.EncodeToString(salt), enc.EncodeToString(key))
+
+	return []byte(hash), nil
+}
+
+func (h Argon2idHasher) Handles(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte(argon2idPrefix))
+}
+
+// Parses a PHC formatted argon2id hash into its parameters, salt and key
+func parseArgon2id(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var (
+		params  Argon2idHasher
+		version int
+		salt    string
+		key     string
+	)
+
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	salt, key = string(parts[4]), string(parts[5])
+
+	enc := base64.RawStdEncoding
+
+	saltBytes, err := enc.DecodeString(salt)
+	if err != nil {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	keyBytes, err := enc.DecodeString(key)
+	if err != nil {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	params.SaltLength = uint32(len(saltBytes))
+	params.KeyLength = uint32(len(keyBytes))
+
+	return params, saltBytes, keyBytes, nil
+}
+
+func (h Argon2idHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintext), salt, params.Time, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := parseArgon2id(hash)
+	return err != nil || params != h
+}
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The states a job moves through. Jobs which succeed are deleted rather than kept, so
+// that the table only holds outstanding work and the dead letters
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDead    = "dead"
+)
+
+// Secrets needed to run a job, such as the plaintext of a token being emailed, go in the
+// payload's top-level "secrets" member. It is removed when the job dies, so that dead
+// letters can be kept for inspection without holding on to anything a reader could use
+// (jobs which succeed are deleted outright)
+const jobSecretsKey = "secrets"
+
+// How long a claimed job is leased to a worker. If the worker dies without finishing the
+// job, another worker can claim it once the lease has expired
+const jobLease = 5 * time.Minute
+
+// Define a Job struct to hold a single unit of background work
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error"`
+}
+
+// Define the JobModel type
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Enqueue() adds a job to the queue, encoding the payload as JSON
+func (m JobModel) Enqueue(kind string, payload any, maxAttempts int) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertJob(ctx, m.DB, kind, payload, maxAttempts)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx, so that a job can be queued on
+// its own or as part of the transaction which makes the work necessary
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertJob(ctx context.Context, q rowQuerier, kind string, payload any, maxAttempts int) (*Job, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO jobs (kind, payload, max_attempts)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, status, run_at`
+
+	job := &Job{
+		Kind:        kind,
+		Payload:     js,
+		MaxAttempts: maxAttempts,
+	}
+
+	err = q.QueryRowContext(ctx, query, kind, []byte(js), maxAttempts).Scan(&job.ID, &job.CreatedAt, &job.Status, &job.RunAt)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return job, nil
+}
+
+// Claim() leases the next job which is due to run, or whose previous lease has expired
+// with attempts to spare.
+// SKIP LOCKED lets any number of workers (in any number of processes) claim jobs at the
+// same time without blocking on, or double-claiming, each other's rows. If there are no
+// jobs to run, ErrRecordNotFound is returned
+func (m JobModel) Claim(ctx context.Context) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = $1, attempts = attempts + 1, locked_until = NOW() + make_interval(secs => $2)
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE (status = $3 AND run_at <= NOW())
+			OR (status = $1 AND locked_until < NOW() AND attempts < max_attempts)
+			ORDER BY run_at ASC, id ASC
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, JobRunning, jobLease.Seconds(), JobPending).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// BuryExpired() moves jobs whose lease expired on their final attempt to the dead state,
+// removing their secrets as Fail() does, and returns them. Their worker died mid-run, so
+// there was never an error to record for that attempt
+func (m JobModel) BuryExpired(ctx context.Context) ([]*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = $1, locked_until = NULL, last_error = $2, payload = payload - $3
+		WHERE status = $4 AND locked_until < NOW() AND attempts >= max_attempts
+		RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, JobDead, "lease expired on final attempt", jobSecretsKey, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+
+	for rows.Next() {
+		var job Job
+
+		err := rows.Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.Kind,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// Complete() removes a job which has run successfully
+func (m JobModel) Complete(id int64) error {
+	query := `
+		DELETE FROM jobs
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return translateError(err)
+}
+
+// Fail() records a failed attempt. The job is retried at retryAt, unless it has used up
+// all of its attempts, in which case it is moved to the dead state and its secrets are
+// removed from the payload
+func (m JobModel) Fail(job *Job, jobErr error, retryAt time.Time) error {
+	job.LastError = jobErr.Error()
+	job.Status = JobPending
+	job.RunAt = retryAt
+
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = JobDead
+	}
+
+	query := `
+		UPDATE jobs
+		SET status = $1, run_at = $2, last_error = $3, locked_until = NULL,
+			payload = CASE WHEN $1 = $5 THEN payload - $6 ELSE payload END
+		WHERE id = $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, job.Status, job.RunAt, job.LastError, job.ID, JobDead, jobSecretsKey)
+	return translateError(err)
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LoginPolicy controls how failed logins are throttled. After each failure the account
+// must wait BackoffBase, doubling with every further failure, before the next attempt is
+// considered. Once MaxAttempts failures have happened in a row, it is locked for Lockout
+type LoginPolicy struct {
+	MaxAttempts int
+	BackoffBase time.Duration
+	Lockout     time.Duration
+}
+
+// Define a LoginAttempts struct to hold the failed login counter for a single user
+type LoginAttempts struct {
+	UserID       int64
+	FailedCount  int
+	LastFailedAt *time.Time
+	LockedUntil  *time.Time
+}
+
+// Blocked() reports whether a login attempt at the given time should be refused without
+// looking at the password, either because the account is locked or still backing off
+func (a *LoginAttempts) Blocked(now time.Time, policy LoginPolicy) bool {
+	if a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+		return true
+	}
+
+	if a.FailedCount == 0 || a.LastFailedAt == nil {
+		return false
+	}
+
+	return now.Before(a.LastFailedAt.Add(policy.backoff(a.FailedCount)))
+}
+
+// RecordFailure() counts a failed login, returning true if this failure locked the
+// account. A lock which has already expired starts the counter again from scratch
+func (a *LoginAttempts) RecordFailure(now time.Time, policy LoginPolicy) bool {
+	if a.LockedUntil != nil && !now.Before(*a.LockedUntil) {
+		a.FailedCount = 0
+		a.LockedUntil = nil
+	}
+
+	a.FailedCount++
+	a.LastFailedAt = &now
+
+	if a.FailedCount >= policy.MaxAttempts {
+		lockedUntil := now.Add(policy.Lockout)
+		a.LockedUntil = &lockedUntil
+		return a.FailedCount == policy.MaxAttempts
+	}
+
+	return false
+}
+
+// Returns the delay which applies after the given number of consecutive failures,
+// doubling each time but never exceeding the lockout duration
+func (p LoginPolicy) backoff(failedCount int) time.Duration {
+	delay := p.BackoffBase
+
+	for i := 1; i < failedCount && delay < p.Lockout; i++ {
+		delay *= 2
+	}
+
+	return min(delay, p.Lockout)
+}
+
+// Define the LoginAttemptModel type. Each model counts failures of one login step in its
+// own table: wrong passwords in login_attempts and wrong second factor codes in
+// mfa_attempts. The counters are kept apart so that a correct password, which resets its
+// own counter, doesn't also give an attacker a fresh set of guesses at the code
+type LoginAttemptModel struct {
+	DB    *sql.DB
+	table string
+}
+
+// Attempt() checks and counts a login attempt for the user in a single transaction, with
+// the counter row locked. The attempt is counted as a failure before the password is known
+// to be right, so that concurrent attempts can't all pass the check before any of them is
+// counted. A successful login then calls Reset(). It returns blocked if the attempt must be
+// refused, in which case nothing is counted, and locked if this attempt locked the account
+func (m LoginAttemptModel) Attempt(userID int64, now time.Time, policy LoginPolicy) (attempts *LoginAttempts, blocked, locked bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer tx.Rollback()
+
+	// Make sure the counter row exists, so that there is a row for FOR UPDATE to lock
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (user_id, failed_count)
+		VALUES ($1, 0)
+		ON CONFLICT (user_id) DO NOTHING`, m.table), userID)
+	if err != nil {
+		return nil, false, false, translateError(err)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT user_id, failed_count, last_failed_at, locked_until
+		FROM %s
+		WHERE user_id = $1
+		FOR UPDATE`, m.table)
+
+	attempts = &LoginAttempts{}
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(
+		&attempts.UserID,
+		&attempts.FailedCount,
+		&attempts.LastFailedAt,
+		&attempts.LockedUntil,
+	)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if attempts.Blocked(now, policy) {
+		return attempts, true, false, nil
+	}
+
+	locked = attempts.RecordFailure(now, policy)
+
+	query = fmt.Sprintf(`
+		UPDATE %s
+		SET failed_count = $2, last_failed_at = $3, locked_until = $4
+		WHERE user_id = $1`, m.table)
+
+	_, err = tx.ExecContext(ctx, query, attempts.UserID, attempts.FailedCount, attempts.LastFailedAt, attempts.LockedUntil)
+	if err != nil {
+		return nil, false, false, translateError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, false, translateError(err)
+	}
+
+	return attempts, false, locked, nil
+}
+
+// Clear the failed login counter for a user, lifting any lockout
+func (m LoginAttemptModel) Reset(userID int64) error {
+	query := fmt.Sprintf(`
+		DELETE FROM %s
+		WHERE user_id = $1`, m.table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return translateError(err)
+}
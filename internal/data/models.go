@@ -12,16 +12,36 @@ var (
 
 // Wraps the MovieModel. Other models like UserModel, PermissionModel will be added
 type Models struct {
-	Movies MovieModel
-	Tokens TokenModel // Add a new Tokens field
-	Users  UserModel
+	APIKeys     APIKeyModel
+	Events      EventModel
+	Jobs        JobModel
+	Logins      LoginAttemptModel
+	MFAAttempts LoginAttemptModel
+	Movies      MovieModel
+	Outbox      OutboxModel
+	Permissions PermissionModel // Add a new Permissions field
+	TOTP        TOTPModel
+	Tokens      TokenModel // Add a new Tokens field
+	Users       UserModel
+	Webhooks    WebhookModel
+	Deliveries  WebhookDeliveryModel
 }
 
 // Returns a Models struct containing the initialized MovieModel and others
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
-		Tokens: TokenModel{DB: db}, // Initialize a new TokenModel instance
-		Users:  UserModel{DB: db},
+		APIKeys:     APIKeyModel{DB: db},
+		Events:      EventModel{DB: db},
+		Jobs:        JobModel{DB: db},
+		Logins:      LoginAttemptModel{DB: db, table: "login_attempts"},
+		MFAAttempts: LoginAttemptModel{DB: db, table: "mfa_attempts"},
+		Movies:      MovieModel{DB: db},
+		Outbox:      OutboxModel{DB: db},
+		Permissions: PermissionModel{DB: db}, // Initialize a new PermissionModel instance
+		TOTP:        TOTPModel{DB: db},
+		Tokens:      TokenModel{DB: db}, // Initialize a new TokenModel instance
+		Users:       UserModel{DB: db},
+		Webhooks:    WebhookModel{DB: db},
+		Deliveries:  WebhookDeliveryModel{DB: db},
 	}
 }
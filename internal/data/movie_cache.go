@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The PostgreSQL notification channel which is notified, with the movie ID, whenever a
+// movie is written. Other application instances LISTEN on it to invalidate their caches
+const MovieCacheChannel = "movie_cache"
+
+// The cache key prefixes for single movies and for GetAll() results
+const (
+	movieCachePrefix     = "movie:"
+	movieListCachePrefix = "movies:"
+)
+
+// A cached page of GetAll() results
+type movieList struct {
+	movies   []*Movie
+	metadata Metadata
+}
+
+func movieCacheKey(id int64) string {
+	return movieCachePrefix + strconv.FormatInt(id, 10)
+}
+
+// Returns the cache key for a GetAll() query. The parameters are normalised first, so
+// that queries which must return the same results share a key: the title search is case
+// and whitespace insensitive, and the order of the genres doesn't matter
+func movieListCacheKey(title string, genres []string, filters Filters) string {
+	genres = slices.Clone(genres)
+	slices.Sort(genres)
+	genres = slices.Compact(genres)
+
+	parts := []string{
+		strings.Join(strings.Fields(strings.ToLower(title)), " "),
+		strings.Join(genres, ","),
+		filters.Sort,
+		strconv.Itoa(filters.Page),
+		strconv.Itoa(filters.PageSize),
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return movieListCachePrefix + hex.EncodeToString(hash[:])
+}
+
+func cloneMovie(movie *Movie) *Movie {
+	clone := *movie
+	clone.Genres = slices.Clone(movie.Genres)
+	return &clone
+}
+
+func cloneMovies(movies []*Movie) []*Movie {
+	clones := make([]*Movie, len(movies))
+	for i, movie := range movies {
+		clones[i] = cloneMovie(movie)
+	}
+
+	return clones
+}
+
+// commit() notifies the other application instances that a movie has changed and commits
+// the transaction which changed it, then invalidates the local cache. The notification
+// is only delivered if the commit succeeds
+func (m MovieModel) commit(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, MovieCacheChannel, strconv.FormatInt(id, 10))
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return translateError(err)
+	}
+
+	m.Invalidate(id)
+	return nil
+}
+
+// Invalidate() removes a movie from the cache, along with every cached GetAll() result,
+// since any of them might include the movie
+func (m MovieModel) Invalidate(id int64) {
+	if m.Cache == nil {
+		return
+	}
+
+	m.Cache.Delete(movieCacheKey(id))
+	m.Cache.DeletePrefix(movieListCachePrefix)
+}
+
+// InvalidateAll() empties the cache. It's used when invalidations may have been missed
+func (m MovieModel) InvalidateAll() {
+	if m.Cache == nil {
+		return
+	}
+
+	m.Cache.Clear()
+}
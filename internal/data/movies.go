@@ -14,53 +14,81 @@ import (
 type Movie struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"` // Do not show in the output
+	UpdatedAt time.Time `json:"-"` // Used for the Last-Modified header
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitzero"` // Hide it if it is zero value
 	Runtime   Runtime   `json:"runtime,omitzero"`
 	Genres    []string  `json:"genres,omitzero"`
 	Version   int32     `json:"version"`
+	UserID    int64     `json:"-"` // ID of the authoring user, zero if unknown
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Use the Check() method to execute our validation checks
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.CheckCode(movie.Title != "", "title", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(movie.Title) <= 500, "title", validator.CodeTooLong, "must not be more than 500 bytes long")
 
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
+	v.CheckCode(movie.Year != 0, "year", validator.CodeRequired, "must be provided")
+	v.CheckCode(movie.Year >= 1888, "year", validator.CodeTooSmall, "must be greater than 1888")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
 
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.CheckCode(movie.Runtime != 0, "runtime", validator.CodeRequired, "must be provided")
+	v.CheckCode(movie.Runtime > 0, "runtime", validator.CodeTooSmall, "must be a positive integer")
 
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.CheckCode(movie.Genres != nil, "genres", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(movie.Genres) >= 1, "genres", validator.CodeTooFew, "must contain at least 1 genre")
+	v.CheckCode(len(movie.Genres) <= 5, "genres", validator.CodeTooMany, "must not contain more than 5 genres")
 	// Using Unique() helper to check all values in the movie.Genres slice are unique
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.CheckCode(validator.Unique(movie.Genres), "genres", validator.CodeDuplicate, "must not contain duplicate values")
 }
 
 // Define MovieModel struct type which wraps a sql.DB connection pool
 type MovieModel struct {
-	DB *sql.DB
+	DB               *sql.DB
+	Cache            Cache // Optional read-through cache for Get() and GetAll(), nil disables it
+	DeliveryAttempts int   // Attempts allowed for each webhook delivery queued by a change
 }
 
 // Accepts a pointer to a Movie struct
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
+		INSERT INTO movies (title, year, runtime, genres, user_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+		RETURNING id, created_at, updated_at, version`
 
-	// Create args slice containing values for the placeholder parameters
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	// Create args slice containing values for the placeholder parameters. A zero
+	// UserID is stored as NULL, since the movie has no known author
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.UserID}
 
 	// Create a context with a 3-second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Use QueryRow() to execute the SQL query on our connection pool
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	// Insert the movie, its change feed event and its webhook deliveries in a single transaction
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Use QueryRow() to execute the SQL query within the transaction. Any constraint
+	// violation is translated into a ConstraintError naming the offending field
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = insertEvent(ctx, tx, EventMovieCreated, movie.ID, movie)
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = queueDeliveries(ctx, tx, EventMovieCreated, movie, m.DeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	return m.commit(ctx, tx, movie.ID)
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -68,8 +96,22 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
+	// Serve the movie from the cache if we can. Cached values are shared, so callers are
+	// given their own copy, which they are free to modify
+	key := movieCacheKey(id)
+
+	var generation uint64
+
+	if m.Cache != nil {
+		if cached, ok := m.Cache.Get(key); ok {
+			return cloneMovie(cached.(*Movie)), nil
+		}
+
+		generation = m.Cache.Generation()
+	}
+
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, updated_at, title, year, runtime, genres, version
 		FROM movies
 		WHERE id = $1`
 
@@ -86,6 +128,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
@@ -99,10 +142,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 			return nil, ErrRecordNotFound
 
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
+	if m.Cache != nil {
+		m.Cache.Set(key, cloneMovie(&movie), generation)
+	}
+
 	// Otherwise, return a pointer to the Movie struct
 	return &movie, nil
 }
@@ -112,9 +159,9 @@ func (m MovieModel) Update(movie *Movie) error {
 	// Add the 'AND version = $6' clause to the SQL query
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+		SET title = $1, year = $2, runtime = $3, genres = $4, updated_at = NOW(), version = version + 1
 		WHERE id = $5 AND version = $6
-		RETURNING version`
+		RETURNING updated_at, version`
 
 	// Create an args slice containing the placeholder parameter values
 	args := []any{
@@ -130,20 +177,37 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	// Update the movie, and write its change feed event and webhook deliveries, in a single transaction
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Execute the SQL query. If no matching row could be found, we know the movie version
 	// has been changed (or record deleted) and we return our custom ErrEditConflict
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
-	return nil
+	err = insertEvent(ctx, tx, EventMovieUpdated, movie.ID, movie)
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = queueDeliveries(ctx, tx, EventMovieUpdated, movie, m.DeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	return m.commit(ctx, tx, movie.ID)
 }
 
 func (m MovieModel) Delete(id int64) error {
@@ -159,10 +223,17 @@ func (m MovieModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	// Delete the movie, and write its change feed event and webhook deliveries, in a single transaction
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
 
 	// Call the RowsAffected() of the sql.Result value to get the affected number of rows
 	rowsAffected, err := result.RowsAffected()
@@ -175,13 +246,36 @@ func (m MovieModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	err = insertEvent(ctx, tx, EventMovieDeleted, id, map[string]any{"id": id})
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = queueDeliveries(ctx, tx, EventMovieDeleted, map[string]any{"id": id}, m.DeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	return m.commit(ctx, tx, id)
 }
 
 // Create a new method which returns a slice of movies
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	key := movieListCacheKey(title, genres, filters)
+
+	var generation uint64
+
+	if m.Cache != nil {
+		if cached, ok := m.Cache.Get(key); ok {
+			list := cached.(*movieList)
+			return cloneMovies(list.movies), list.metadata, nil
+		}
+
+		generation = m.Cache.Generation()
+	}
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, version
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
@@ -197,7 +291,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// Pass the title and genres as the placeholder parameter values
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, translateError(err)
 	}
 
 	// Defer a call to rows.Close() to ensure that the resultset is closed before GetAll() returns
@@ -214,6 +308,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
@@ -237,6 +332,98 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// Generate Metadata struct, passing in the total record count and pagination parameters from client
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
+	if m.Cache != nil {
+		m.Cache.Set(key, &movieList{movies: cloneMovies(movies), metadata: metadata}, generation)
+	}
+
 	// Include Metadata struct when returning
 	return movies, metadata, nil
 }
+
+// LastModified() returns the time of the most recent change to any movie, or the zero time
+// if there are none. Deletions leave no trace in the movies table, so the change feed is
+// checked as well. Events are written in ID order, so the newest is found through the
+// primary key rather than by scanning every created_at. The result is cached alongside
+// the GetAll() results, and invalidated with them
+func (m MovieModel) LastModified() (time.Time, error) {
+	key := movieListCachePrefix + "last-modified"
+
+	var generation uint64
+
+	if m.Cache != nil {
+		if cached, ok := m.Cache.Get(key); ok {
+			return cached.(time.Time), nil
+		}
+
+		generation = m.Cache.Generation()
+	}
+
+	query := `
+		SELECT GREATEST(
+			(SELECT MAX(updated_at) FROM movies),
+			(SELECT created_at FROM events ORDER BY id DESC LIMIT 1)
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lastModified sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&lastModified)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if m.Cache != nil {
+		m.Cache.Set(key, lastModified.Time, generation)
+	}
+
+	return lastModified.Time, nil
+}
+
+// Returns all movies authored by a specific user, ordered by ID
+func (m MovieModel) GetAllForUser(userID int64) ([]*Movie, error) {
+	query := `
+		SELECT id, created_at, updated_at, title, year, runtime, genres, version
+		FROM movies
+		WHERE user_id = $1
+		ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		movie := Movie{UserID: userID}
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
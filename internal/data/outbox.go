@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The delivery states of an outbox email
+const (
+	OutboxQueued = "queued"
+	OutboxSent   = "sent"
+	OutboxFailed = "failed"
+)
+
+// Define an OutboxEmail struct to record the delivery of a single email. The rendered
+// message isn't stored, only enough to tell what was sent to whom and whether it arrived
+type OutboxEmail struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Template  string     `json:"template"`
+	Recipient string     `json:"recipient"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
+// Define the OutboxModel type
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// Insert() records a newly queued email, and queues the job which sends it in the same
+// transaction, so there is never an outbox record without a job or a job without a record.
+// The job's payload is built by payload(), once the email's ID is known
+func (m OutboxModel) Insert(email *OutboxEmail, jobKind string, payload func(outboxID int64) any, maxAttempts int) error {
+	query := `
+		INSERT INTO email_outbox (template, recipient)
+		VALUES ($1, $2)
+		RETURNING id, created_at, status`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, email.Template, email.Recipient).Scan(&email.ID, &email.CreatedAt, &email.Status)
+	if err != nil {
+		return translateError(err)
+	}
+
+	_, err = insertJob(ctx, tx, jobKind, payload(email.ID), maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Retrieve the emails sent (or not) to a recipient, most recent first
+func (m OutboxModel) GetAllForRecipient(recipient string) ([]*OutboxEmail, error) {
+	query := `
+		SELECT id, created_at, template, recipient, status, attempts, last_error, sent_at
+		FROM email_outbox
+		WHERE recipient = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 100`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	emails := []*OutboxEmail{}
+
+	for rows.Next() {
+		var email OutboxEmail
+
+		err := rows.Scan(
+			&email.ID,
+			&email.CreatedAt,
+			&email.Template,
+			&email.Recipient,
+			&email.Status,
+			&email.Attempts,
+			&email.LastError,
+			&email.SentAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// MarkSent() records a successful delivery attempt
+func (m OutboxModel) MarkSent(id int64) error {
+	query := `
+		UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1, last_error = '', sent_at = NOW()
+		WHERE id = $2`
+
+	return m.update(query, OutboxSent, id)
+}
+
+// RecordFailure() records a failed delivery attempt. If final is true the email won't be
+// tried again, so it is marked as failed; otherwise it stays queued
+func (m OutboxModel) RecordFailure(id int64, sendErr error, final bool) error {
+	status := OutboxQueued
+	if final {
+		status = OutboxFailed
+	}
+
+	query := `
+		UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1, last_error = $2
+		WHERE id = $3`
+
+	return m.update(query, status, sendErr.Error(), id)
+}
+
+func (m OutboxModel) update(query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -5,22 +5,73 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/azizjon12/greenlight/internal/validator"
 )
 
 const (
-	ScopeActivation = "activation"
+	ScopeActivation     = "activation"
+	ScopeAuthentication = "authentication" // Include a new authentication scope
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFAChallenge   = "mfa-challenge"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been rotated is
+// presented again. This means the token has leaked, so its whole family is revoked
+var ErrTokenReused = errors.New("token reused")
+
 // Define a Token struct to hold the data for an individual token
+// Add struct tags to control how the struct appears when encoded to JSON. The plaintext
+// is omitted when empty, so that token metadata can be listed without it
 type Token struct {
-	Plaintext string
-	Hash      []byte
-	UserID    int64
-	Expiry    time.Time
-	Scope     string
+	Plaintext string    `json:"token,omitzero"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"scope"`
+	Family    []byte    `json:"-"` // Shared by all tokens issued from the same login
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// Client holds the details of the device a token was issued to or used from
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+// Session describes a logged-in device. The plaintext token is never stored, so each
+// session is identified by a prefix of its token hash instead. UserAgent and IP are those
+// of the client the session was issued to, and LastUserAgent and LastIP those of the client
+// which last used it
+type Session struct {
+	ID            string     `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastUsedAt    *time.Time `json:"last_used_at"`
+	Expiry        time.Time  `json:"expiry"`
+	UserAgent     string     `json:"user_agent"`
+	IP            string     `json:"ip"`
+	LastUserAgent string     `json:"last_user_agent"`
+	LastIP        string     `json:"last_ip"`
+	Current       bool       `json:"current"`
+}
+
+// Number of hash bytes used for a session identifier
+const sessionIDLength = 8
+
+// SessionID() returns the session identifier for a token hash
+func SessionID(hash []byte) string {
+	return hex.EncodeToString(hash[:sessionIDLength])
+}
+
+// SessionIDForPlaintext() returns the session identifier for a plaintext token
+func SessionIDForPlaintext(tokenPlaintext string) string {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return SessionID(hash[:])
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) *Token {
@@ -44,7 +95,7 @@ func generateToken(userID int64, ttl time.Duration, scope string) *Token {
 
 // Check that the plaintext token has been provided and is exactly 26 bytes long
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.CheckCode(tokenPlaintext != "", "token", validator.CodeRequired, "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
@@ -61,19 +112,39 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewFamily() returns a random identifier for a new token family. All authentication
+// and refresh tokens descending from a single login share the same family
+func NewFamily() []byte {
+	family := make([]byte, 16)
+	rand.Read(family)
+	return family
+}
+
+// Like New(), but the token is created as part of an existing token family and records
+// the client it was issued to
+func (m TokenModel) NewInFamily(userID int64, ttl time.Duration, scope string, family []byte, client Client) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+	token.Family = family
+	token.UserAgent = client.UserAgent
+	token.IP = client.IP
+
+	err := m.Insert(token)
+	return token, err
+}
+
 // Adds the data for a specific token to the token table
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.UserAgent, token.IP}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return translateError(err)
 }
 
 // Deletes all tokens for a specific user and scope
@@ -86,5 +157,238 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
-	return err
+	return translateError(err)
+}
+
+// Deletes all tokens for a specific user, regardless of their scope
+func (m TokenModel) DeleteAllScopesForUser(userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return translateError(err)
+}
+
+// Returns the metadata (scope and expiry) of all unexpired tokens for a specific user.
+// The plaintext is never stored, and the hash is never exposed, so neither is returned
+func (m TokenModel) GetAllForUser(userID int64) ([]*Token, error) {
+	query := `
+		SELECT scope, expiry
+		FROM tokens
+		WHERE user_id = $1 AND expiry > $2 AND used_at IS NULL
+		ORDER BY expiry ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		token := Token{UserID: userID}
+
+		err := rows.Scan(&token.Scope, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// ClaimRefresh() marks an unused, unexpired refresh token as used and returns it, so that
+// the caller can issue its replacement in the same family. If the token has already been
+// used, every token in its family is deleted and ErrTokenReused is returned
+func (m TokenModel) ClaimRefresh(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = $1 AND scope = $2 AND used_at IS NULL AND expiry > $3
+		RETURNING user_id, expiry, family`
+
+	token := Token{
+		Hash:  tokenHash[:],
+		Scope: ScopeRefresh,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, token.Hash, ScopeRefresh, time.Now()).Scan(&token.UserID, &token.Expiry, &token.Family)
+	if err == nil {
+		return &token, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, translateError(err)
+	}
+
+	// The token wasn't claimable. Check whether that is because it was rotated already
+	query = `
+		SELECT family
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL`
+
+	err = m.DB.QueryRowContext(ctx, query, token.Hash, ScopeRefresh).Scan(&token.Family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+
+		default:
+			return nil, err
+		}
+	}
+
+	err = m.DeleteFamily(token.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, ErrTokenReused
+}
+
+// Deletes every token belonging to a token family
+func (m TokenModel) DeleteFamily(family []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return translateError(err)
+}
+
+// Deletes a specific token along with the rest of its family, if it has one
+func (m TokenModel) DeleteWithFamily(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+		OR family = (SELECT family FROM tokens WHERE hash = $1 AND scope = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	return translateError(err)
+}
+
+// Records that a token has just been used by a client. The client the token was issued to
+// is kept as it was, and this one is stored alongside it. To avoid a write on every single
+// request, last_used_at is only refreshed once it is more than a minute old
+func (m TokenModel) Touch(scope, tokenPlaintext string, client Client) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW(), last_user_agent = $3, last_ip = $4
+		WHERE hash = $1 AND scope = $2
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope, client.UserAgent, client.IP)
+	return translateError(err)
+}
+
+// Returns the active sessions (unexpired authentication tokens) for a specific user,
+// most recently created first
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT hash, created_at, last_used_at, expiry, user_agent, ip, last_user_agent, last_ip
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var (
+			session Session
+			hash    []byte
+		)
+
+		err := rows.Scan(&hash, &session.CreatedAt, &session.LastUsedAt, &session.Expiry, &session.UserAgent, &session.IP, &session.LastUserAgent, &session.LastIP)
+		if err != nil {
+			return nil, err
+		}
+
+		session.ID = SessionID(hash)
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Revokes a single session for a specific user, deleting its authentication token and
+// every other token (such as the refresh token) in the same family
+func (m TokenModel) DeleteSession(userID int64, sessionID string) error {
+	prefix, err := hex.DecodeString(sessionID)
+	if err != nil || len(prefix) != sessionIDLength {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		WITH session AS (
+			SELECT hash, family
+			FROM tokens
+			WHERE user_id = $1 AND scope = $2 AND substring(hash FROM 1 FOR $3) = $4
+		)
+		DELETE FROM tokens
+		WHERE user_id = $1
+		AND (hash IN (SELECT hash FROM session) OR family IN (SELECT family FROM session))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, sessionIDLength, prefix)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
 }
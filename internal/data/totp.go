@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Number of one-time recovery codes issued when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+// Define a TOTP struct to hold a user's two-factor authentication secret. The secret is
+// pending until the user proves their authenticator app works by submitting a code
+type TOTP struct {
+	UserID   int64
+	Secret   string
+	Enabled  bool
+	LastStep int64 // The last time step a code was accepted for, to prevent replays
+}
+
+// Check that the code has been provided and is either a 6-digit TOTP code or a recovery code
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.CheckCode(code != "", "code", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(code) <= 32, "code", validator.CodeTooLong, "must not be more than 32 bytes long")
+}
+
+// Recovery codes are shown to the user as "xxxxx-xxxxx", but accepted in any case and
+// with or without the dash
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+func generateRecoveryCode() string {
+	code := rand.Text()[:10]
+	return code[:5] + "-" + code[5:]
+}
+
+// Define the TOTPModel type. Secrets are stored in plaintext on purpose: unlike a password,
+// the server needs the secret itself to compute the expected code, so a hash would be
+// useless. Encrypting it would only help against a leak of the database alone, and needs
+// key management the application doesn't have yet, so access to the totp_secrets table
+// must be restricted as tightly as the credentials themselves
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Retrieve the TOTP details for a specific user, or ErrRecordNotFound if they have never
+// started enrolling
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, secret, enabled, last_step
+		FROM totp_secrets
+		WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.UserID, &totp.Secret, &totp.Enabled, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// Store a new pending secret for a user, replacing any earlier pending secret. A secret
+// which has already been enabled is left untouched, and ErrEditConflict returned
+func (m TOTPModel) SetPending(userID int64, secret string) error {
+	query := `
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+		WHERE totp_secrets.enabled = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Turn on two-factor authentication for the user, recording the step of the code used, and
+// issue their recovery codes. Both happen in one transaction, so the user can't be left
+// with two-factor authentication on and no way to recover the account. The plaintext codes
+// are returned, and this is the only time they are available, since only hashes are stored
+func (m TOTPModel) Enable(userID int64, step int64) ([]string, error) {
+	query := `
+		UPDATE totp_secrets
+		SET enabled = true, last_step = $2
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	codes, err := insertRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, translateError(tx.Commit())
+}
+
+// Record that a code has been accepted for a time step. If a code for the same or a later
+// step was accepted concurrently, ErrEditConflict is returned and the code must be rejected
+func (m TOTPModel) RecordStep(userID int64, step int64) error {
+	query := `
+		UPDATE totp_secrets
+		SET last_step = $2
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Turn off two-factor authentication, removing the secret and any recovery codes together
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_secrets WHERE user_id = $1`, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// Replace the user's recovery codes with a fresh set as part of a transaction, returning
+// the plaintext codes
+func insertRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		codes[i] = generateRecoveryCode()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	query := `
+		INSERT INTO recovery_codes (hash, user_id)
+		SELECT hash, $1 FROM unnest($2::bytea[]) AS hash`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.ByteaArray(hashes))
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return codes, nil
+}
+
+// Consume a recovery code, returning true if it was valid. Each code works only once
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
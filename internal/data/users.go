@@ -2,13 +2,16 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/azizjon12/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/language"
 )
 
 // Define a custom ErrDuplicateEmail error
@@ -16,16 +19,25 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// Declare a new AnonymousUser variable
+var AnonymousUser = &User{}
+
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
+	Locale    string    `json:"locale"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
 }
 
+// Check if a User instance is the AnonymousUser
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
 // Create a custom password type which is a struct containing the plaintext and
 // hashed versions of the password user. The plaintext field is a *pointer* to a string,
 // so that we're able to distinguish between a plaintext password not being present in
@@ -35,10 +47,10 @@ type password struct {
 	hash      []byte
 }
 
-// Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct
+// Set() method calculates the hash of a plaintext password using the current password
+// hasher, and stores both the hash and the plaintext versions in the struct
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := currentHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -50,39 +62,69 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Matches() checks whether the provided plaintext password matches the hashed password
-// stored in the struct, returning true if matches and false otherwise
+// stored in the struct, returning true if matches and false otherwise. The hash may have
+// been produced by any supported hasher, not only the current one
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
 
-	return true, nil
+	return hasher.Matches(p.hash, plaintextPassword)
+}
+
+// NeedsUpgrade() reports whether the stored hash was produced by a different algorithm,
+// or with different parameters, than the current password hasher would use. Once the
+// plaintext password is known to match, it can be re-hashed with Set() and saved
+func (p *password) NeedsUpgrade() bool {
+	return !currentHasher.Handles(p.hash) || currentHasher.NeedsRehash(p.hash)
+}
+
+// A throwaway password hash, computed once on first use, which lets us spend the same
+// time checking a password when there is no matching user as when there is one
+var dummyPassword = sync.OnceValue(func() *password {
+	var p password
+	p.Set(rand.Text())
+	return &p
+})
+
+// SimulatePasswordMatch() performs the same work as Matches() against a dummy hash, so
+// that login attempts for unknown emails can't be told apart by their response time
+func SimulatePasswordMatch(plaintextPassword string) {
+	dummyPassword().Matches(plaintextPassword)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
+	v.CheckCode(email != "", "email", validator.CodeRequired, "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRegEx), "email", "must be a valid email address")
 }
 
+// ValidateLocale() checks that a locale is a well-formed BCP 47 language tag, like "en"
+// or "es-MX". Tags without translated email templates are allowed, and fall back to the
+// default locale when emails are sent
+func ValidateLocale(v *validator.Validator, locale string) {
+	_, err := language.Parse(locale)
+
+	v.CheckCode(locale != "", "locale", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(locale) <= 35, "locale", validator.CodeTooLong, "must not be more than 35 bytes long")
+	v.Check(err == nil, "locale", "must be a valid language tag")
+}
+
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.CheckCode(password != "", "password", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(password) >= 8, "password", validator.CodeTooShort, "must be at least 8 bytes long")
+	v.CheckCode(len(password) <= 72, "password", validator.CodeTooLong, "must not be more than 72 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.CheckCode(user.Name != "", "name", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(user.Name) <= 500, "name", validator.CodeTooLong, "must not be more than 500 bytes long")
 
 	// Call the standalone ValidateEmail() helper
 	ValidateEmail(v, user.Email)
 
+	ValidateLocale(v, user.Locale)
+
 	// If the plaintext password is not nil, call the standalone ValidatePasswordPlaintext() helper
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
@@ -99,7 +141,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Create a UserModel struct which wraps the connection pool
 type UserModel struct {
-	DB *sql.DB
+	DB               *sql.DB
+	DeliveryAttempts int // Attempts allowed for each webhook delivery queued by a change
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and
@@ -108,19 +151,21 @@ type UserModel struct {
 // that we did when creating a movie
 func (m UserModel) Insert(user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, locale, password_hash, activated)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []any{user.Name, user.Email, user.Locale, user.Password.hash, user.Activated}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
+		err = translateError(err)
+
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isConstraint(err, "users_email_key"):
 			return ErrDuplicateEmail
 
 		default:
@@ -131,12 +176,112 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, locale, password_hash, activated, version
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Locale,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return &user, nil
+}
+
+// Returns a page of users matching the given filters. An empty email matches every
+// user, and a nil activated, createdFrom or createdTo value disables that filter. The
+// sort column is taken from the Filters safelist, in the same way as for movies. createdFrom
+// is inclusive and createdTo is exclusive
+func (m UserModel) GetAll(email string, activated *bool, createdFrom, createdTo *time.Time, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, locale, password_hash, activated, version
+		FROM users
+		WHERE (strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+		AND ($2::boolean IS NULL OR activated = $2)
+		AND ($3::timestamptz IS NULL OR created_at >= $3)
+		AND ($4::timestamptz IS NULL OR created_at < $4)
+		ORDER BY %s %s, id ASC
+		LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{email, activated, createdFrom, createdTo, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Locale,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return an ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, locale, password_hash, activated, version
 		FROM users
 		WHERE email = $1`
 
@@ -150,6 +295,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Locale,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
@@ -161,7 +307,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 			return nil, ErrRecordNotFound
 
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
@@ -175,13 +321,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, locale = $3, password_hash = $4, activated = $5, version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
 	args := []any{
 		user.Name,
 		user.Email,
+		user.Locale,
 		user.Password.hash,
 		user.Activated,
 		user.ID,
@@ -193,8 +340,10 @@ func (m UserModel) Update(user *User) error {
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
+		err = translateError(err)
+
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isConstraint(err, "users_email_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -207,13 +356,53 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// Activate() marks a user as activated, queueing the user.activated webhook deliveries in
+// the same transaction. Like Update(), it fails with ErrEditConflict if the user record has
+// changed since it was read
+func (m UserModel) Activate(user *User) error {
+	query := `
+		UPDATE users
+		SET activated = true, version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+
+		default:
+			return translateError(err)
+		}
+	}
+
+	user.Activated = true
+
+	err = queueDeliveries(ctx, tx, EventUserActivated, user, m.DeliveryAttempts)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the sha256 hash of the plaintext token provided by the client.
 	// Note, it returns a byte *array* with length 32, not a slice
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.locale, users.password_hash, users.activated, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -238,6 +427,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Locale,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
@@ -249,10 +439,43 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			return nil, ErrRecordNotFound
 
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
 	// Return the matching user
 	return &user, nil
 }
+
+// Delete the record for a specific user. The tokens and users_permissions tables
+// reference users with ON DELETE CASCADE, and the movies table with ON DELETE SET NULL,
+// so the user's tokens and permissions are removed and any movies they authored are
+// anonymised as part of the same statement
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,374 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// The events which webhooks can subscribe to
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventUserActivated = "user.activated"
+)
+
+var WebhookEvents = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventUserActivated}
+
+// The kind of the job which delivers a webhook. Its payload is {"delivery_id": <id>}
+const JobDeliverWebhook = "deliver_webhook"
+
+// The delivery states of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Define a Webhook struct to hold a subscription to one or more events. The secret is
+// used to sign deliveries, and is only included in responses when the webhook is created
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitzero"`
+	Events    []string  `json:"events"`
+}
+
+// Define a WebhookDelivery struct to record the delivery of a single event to a webhook
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// NewWebhookSecret() generates a random secret for signing deliveries
+func NewWebhookSecret() string {
+	return "whsec_" + rand.Text()
+}
+
+// Address ranges which aren't covered by the netip.Addr methods but still aren't public
+// unicast addresses: "this network", carrier-grade NAT, IETF protocol assignments,
+// benchmarking, reserved space, and NAT64, which can map back onto any IPv4 address
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// PrivateAddress() reports whether an address is loopback, link-local, private or otherwise
+// not a public unicast address. Webhooks may not be delivered to such addresses, so that
+// they can't be used to reach services on the server's own network
+func PrivateAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return true
+	}
+
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func privateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	return err == nil && PrivateAddress(addr)
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	u, err := url.Parse(webhook.URL)
+
+	v.CheckCode(webhook.URL != "", "url", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(webhook.URL) <= 2000, "url", validator.CodeTooLong, "must not be more than 2000 bytes long")
+	v.Check(err == nil && validator.PermittedValue(u.Scheme, "http", "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.Check(err != nil || !privateHost(u.Hostname()), "url", "must not be a loopback, link-local or private address")
+
+	v.CheckCode(len(webhook.Secret) >= 16, "secret", validator.CodeTooShort, "must be at least 16 bytes long")
+	v.CheckCode(len(webhook.Secret) <= 200, "secret", validator.CodeTooLong, "must not be more than 200 bytes long")
+
+	v.CheckCode(len(webhook.Events) >= 1, "events", validator.CodeTooFew, "must contain at least 1 event")
+	v.CheckCode(validator.Unique(webhook.Events), "events", validator.CodeDuplicate, "must not contain duplicate values")
+
+	for _, event := range webhook.Events {
+		v.Check(validator.PermittedValue(event, WebhookEvents...), "events", "must only contain supported events")
+	}
+}
+
+// Define the WebhookModel type
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, events)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	args := []any{webhook.URL, webhook.Secret, pq.Array(webhook.Events)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt)
+	return translateError(err)
+}
+
+// Returns all of the webhooks, without their secrets
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, events
+		FROM webhooks
+		ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Deletes a webhook, along with its delivery log
+func (m WebhookModel) Delete(id int64) error {
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Define the WebhookDeliveryModel type
+type WebhookDeliveryModel struct {
+	DB *sql.DB
+}
+
+// queueDeliveries() creates a pending delivery of an event for every webhook subscribed
+// to it, along with the job which delivers each one, as part of tx. The deliveries are
+// queued if and only if the change which caused the event is committed
+func queueDeliveries(ctx context.Context, tx *sql.Tx, event string, payload any, maxAttempts int) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		WITH deliveries AS (
+			INSERT INTO webhook_deliveries (webhook_id, event, payload)
+			SELECT id, $1::text, $2::jsonb
+			FROM webhooks
+			WHERE $1::text = ANY(events)
+			RETURNING id
+		)
+		INSERT INTO jobs (kind, payload, max_attempts)
+		SELECT $3, jsonb_build_object('delivery_id', id), $4
+		FROM deliveries`
+
+	_, err = tx.ExecContext(ctx, query, event, []byte(js), JobDeliverWebhook, maxAttempts)
+	return translateError(err)
+}
+
+// Get() retrieves a delivery along with the URL and secret of its webhook
+func (m WebhookDeliveryModel) Get(id int64) (*WebhookDelivery, *Webhook, error) {
+	query := `
+		SELECT webhook_deliveries.id, webhook_deliveries.created_at, webhook_deliveries.event,
+			webhook_deliveries.payload, webhook_deliveries.status, webhook_deliveries.attempts,
+			webhooks.id, webhooks.url, webhooks.secret
+		FROM webhook_deliveries
+		INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+		WHERE webhook_deliveries.id = $1`
+
+	var (
+		delivery WebhookDelivery
+		webhook  Webhook
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&webhook.ID,
+		&webhook.URL,
+		&webhook.Secret,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+
+		default:
+			return nil, nil, err
+		}
+	}
+
+	delivery.WebhookID = webhook.ID
+
+	return &delivery, &webhook, nil
+}
+
+// Returns the most recent deliveries to a webhook, newest first
+func (m WebhookDeliveryModel) GetAllForWebhook(webhookID int64) ([]*WebhookDelivery, error) {
+	query := `
+		SELECT id, created_at, webhook_id, event, payload, status, attempts, response_status, last_error, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 100`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.DeliveredAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt() records the outcome of a delivery attempt. A nil deliveryErr means the
+// event was delivered. Otherwise the delivery stays pending unless final is true, in which
+// case it won't be tried again and is marked as failed
+func (m WebhookDeliveryModel) RecordAttempt(id int64, responseStatus int, deliveryErr error, final bool) error {
+	status := DeliveryDelivered
+	lastError := ""
+
+	if deliveryErr != nil {
+		status = DeliveryPending
+		lastError = deliveryErr.Error()
+
+		if final {
+			status = DeliveryFailed
+		}
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = attempts + 1, response_status = NULLIF($2, 0), last_error = $3,
+			delivered_at = CASE WHEN $1::text = 'delivered' THEN NOW() END
+		WHERE id = $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, status, responseStatus, lastError, id)
+	return translateError(err)
+}
@@ -0,0 +1,89 @@
+package data
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/azizjon12/greenlight/internal/validator"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://hooks.example.com/greenlight", true},
+		{"http://203.0.113.10:8080/hook", true},
+		{"ftp://hooks.example.com/greenlight", false},
+		{"/relative/path", false},
+		{"http://localhost:4000/hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://172.16.0.1/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[fe80::1]/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+		{"http://100.64.0.1/hook", false},
+		{"http://[64:ff9b::a9fe:a9fe]/hook", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			webhook := &Webhook{
+				URL:    tt.url,
+				Secret: NewWebhookSecret(),
+				Events: []string{EventMovieCreated},
+			}
+
+			v := validator.New()
+			ValidateWebhook(v, webhook)
+
+			_, invalid := v.Errors["url"]
+			if invalid == tt.valid {
+				t.Errorf("got url error %q; want valid = %t", v.Errors["url"], tt.valid)
+			}
+		})
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		private bool
+	}{
+		{"8.8.8.8", false},
+		{"203.0.113.10", false},
+		{"2606:4700::1111", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"169.254.169.254", true},
+		{"::ffff:10.0.0.1", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"192.0.0.8", true},
+		{"192.0.1.1", false},
+		{"198.18.0.1", true},
+		{"198.19.255.254", true},
+		{"198.20.0.1", false},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::808:808", true},
+		{"64:ff9b:1::1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := PrivateAddress(netip.MustParseAddr(tt.addr)); got != tt.private {
+				t.Errorf("got %t; want %t", got, tt.private)
+			}
+		})
+	}
+}
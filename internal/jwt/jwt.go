@@ -0,0 +1,279 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// Allowed clock skew between the issuing and verifying machines
+const leeway = 30 * time.Second
+
+// Audience holds the "aud" claim. The JWT spec allows it to be either a single string
+// or an array of strings, so we accept both when decoding
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+
+	*a = many
+	return nil
+}
+
+// Claims holds the registered claims we issue and check, plus an optional session ID
+// linking the token to the refresh token family it was issued with
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  Audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	SessionID string   `json:"sid,omitempty"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+type key struct {
+	id         string
+	algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// Parses a key specification in the format "<kid>:<alg>:<base64 key>". For HS256 the key
+// is the shared secret, and for EdDSA it is the 32-byte Ed25519 seed
+func parseKey(spec string) (*key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("jwt: key must be in the format <kid>:<alg>:<base64 key>")
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %q is not valid base64", parts[0])
+	}
+
+	k := &key{id: parts[0], algorithm: parts[1]}
+
+	switch k.algorithm {
+	case AlgHS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", k.id)
+		}
+		k.secret = material
+
+	case AlgEdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt: EdDSA key %q must be a %d-byte seed", k.id, ed25519.SeedSize)
+		}
+		k.privateKey = ed25519.NewKeyFromSeed(material)
+		k.publicKey = k.privateKey.Public().(ed25519.PublicKey)
+
+	default:
+		return nil, fmt.Errorf("jwt: key %q has unsupported algorithm %q", k.id, k.algorithm)
+	}
+
+	return k, nil
+}
+
+func (k *key) sign(input []byte) []byte {
+	if k.algorithm == AlgEdDSA {
+		return ed25519.Sign(k.privateKey, input)
+	}
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *key) verify(input, signature []byte) bool {
+	if k.algorithm == AlgEdDSA {
+		return ed25519.Verify(k.publicKey, input, signature)
+	}
+
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// Signer issues and verifies tokens for a single issuer and audience. New tokens are
+// signed with the first key, while any of the keys are accepted when verifying, so that
+// a key can be rotated out without invalidating the tokens it has already signed
+type Signer struct {
+	issuer     string
+	audience   string
+	signingKey *key
+	keys       map[string]*key
+}
+
+func New(issuer, audience string, keySpecs []string) (*Signer, error) {
+	if len(keySpecs) == 0 {
+		return nil, errors.New("jwt: at least one key must be provided")
+	}
+
+	signer := &Signer{
+		issuer:   issuer,
+		audience: audience,
+		keys:     make(map[string]*key),
+	}
+
+	for _, spec := range keySpecs {
+		k, err := parseKey(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := signer.keys[k.id]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", k.id)
+		}
+
+		if signer.signingKey == nil {
+			signer.signingKey = k
+		}
+
+		signer.keys[k.id] = k
+	}
+
+	return signer, nil
+}
+
+// Sign() returns a signed token for the subject which expires after the given ttl
+func (s *Signer) Sign(subject, sessionID string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
+
+	claims := Claims{
+		Subject:   subject,
+		Issuer:    s.issuer,
+		Audience:  Audience{s.audience},
+		ExpiresAt: expiry.Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		SessionID: sessionID,
+	}
+
+	h := header{
+		Algorithm: s.signingKey.algorithm,
+		Type:      "JWT",
+		KeyID:     s.signingKey.id,
+	}
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(headerJSON) + "." + enc.EncodeToString(claimsJSON)
+	signature := s.signingKey.sign([]byte(signingInput))
+
+	return signingInput + "." + enc.EncodeToString(signature), expiry, nil
+}
+
+// Verify() checks the token's signature and its exp, nbf, iss and aud claims, returning
+// the claims if the token is valid
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	enc := base64.RawURLEncoding
+
+	headerJSON, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// Look the key up by its kid, falling back to the signing key for tokens without one
+	k := s.signingKey
+	if h.KeyID != "" {
+		var ok bool
+		if k, ok = s.keys[h.KeyID]; !ok {
+			return nil, ErrUnknownKey
+		}
+	}
+
+	// Never let the token choose the algorithm, only accept the one the key was set up with
+	if h.Algorithm != k.algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !k.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claimsJSON, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Subject == "":
+		return nil, ErrInvalidToken
+	case claims.Issuer != s.issuer:
+		return nil, ErrInvalidToken
+	case !slices.Contains(claims.Audience, s.audience):
+		return nil, ErrInvalidToken
+	case now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, ErrInvalidToken
+	case now.Add(-leeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
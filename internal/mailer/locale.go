@@ -0,0 +1,152 @@
+package mailer
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+	"golang.org/x/text/number"
+
+	ht "html/template"
+	tt "text/template"
+)
+
+// DefaultLocale is used for users whose locale has no templates of its own
+const DefaultLocale = "en"
+
+// The locales which have translated templates and formatting rules, with the default first
+var locales = []language.Tag{language.English, language.Spanish}
+
+var localeMatcher = language.NewMatcher(locales)
+
+// The catalog holds the locale-specific strings used by the template formatting functions.
+// The keys are the English format strings
+var formats = func() *catalog.Builder {
+	b := catalog.NewBuilder(catalog.Fallback(language.English))
+
+	for _, tag := range locales {
+		b.Set(tag, "%d days", plural.Selectf(1, "%d", "=1", pick(tag, "%d day", "%d día"), "other", pick(tag, "%d days", "%d días")))
+		b.Set(tag, "%d hours", plural.Selectf(1, "%d", "=1", pick(tag, "%d hour", "%d hora"), "other", pick(tag, "%d hours", "%d horas")))
+		b.Set(tag, "%d minutes", plural.Selectf(1, "%d", "=1", pick(tag, "%d minute", "%d minuto"), "other", pick(tag, "%d minutes", "%d minutos")))
+	}
+
+	b.SetString(language.English, "date", "%[1]s %[2]d, %[3]s at %[4]s UTC")
+	b.SetString(language.Spanish, "date", "%[2]d de %[1]s de %[3]s a las %[4]s UTC")
+
+	spanishMonths := []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}
+	for i, month := range spanishMonths {
+		b.SetString(language.Spanish, time.Month(i+1).String(), month)
+	}
+
+	return b
+}()
+
+// Returns the English or Spanish string, depending on the tag
+func pick(tag language.Tag, en, es string) string {
+	if tag == language.Spanish {
+		return es
+	}
+
+	return en
+}
+
+// MatchLocale() returns the supported locale which best matches a user's preferred
+// locale, or DefaultLocale if there's no reasonable match (or the locale is invalid)
+func MatchLocale(locale string) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return DefaultLocale
+	}
+
+	_, index, confidence := localeMatcher.Match(tag)
+	if confidence == language.No {
+		return DefaultLocale
+	}
+
+	return locales[index].String()
+}
+
+// Returns the functions available to templates in a locale, for formatting dates,
+// durations and numbers. Because the template data passes through the job queue as JSON,
+// they also accept the JSON forms of their arguments: RFC 3339 strings for times, and
+// nanosecond counts or Go duration strings for durations
+func localeFuncs(locale string) map[string]any {
+	p := message.NewPrinter(language.Make(locale), message.Catalog(formats))
+
+	return map[string]any{
+		"date": func(v any) (string, error) {
+			t, err := toTime(v)
+			if err != nil {
+				return "", err
+			}
+
+			// The year is passed preformatted, so it isn't printed with digit grouping
+			t = t.UTC()
+			return p.Sprintf("date", p.Sprintf(t.Month().String()), t.Day(), t.Format("2006"), t.Format("15:04")), nil
+		},
+		"duration": func(v any) (string, error) {
+			d, err := toDuration(v)
+			if err != nil {
+				return "", err
+			}
+
+			// Use the largest unit which divides the duration exactly
+			switch {
+			case d%(24*time.Hour) == 0:
+				return p.Sprintf("%d days", int(d/(24*time.Hour))), nil
+			case d%time.Hour == 0:
+				return p.Sprintf("%d hours", int(d/time.Hour)), nil
+			default:
+				return p.Sprintf("%d minutes", int(d.Round(time.Minute)/time.Minute)), nil
+			}
+		},
+		"number": func(v any) string {
+			return p.Sprint(number.Decimal(v))
+		},
+	}
+}
+
+func textFuncs(locale string) tt.FuncMap {
+	return tt.FuncMap(localeFuncs(locale))
+}
+
+func htmlFuncs(locale string) ht.FuncMap {
+	return ht.FuncMap(localeFuncs(locale))
+}
+
+func toTime(v any) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case *time.Time:
+		return *v, nil
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			// Emails queued by earlier versions passed dates preformatted as RFC 1123
+			return time.Parse(time.RFC1123, v)
+		}
+
+		return t, nil
+	default:
+		return time.Time{}, fmt.Errorf("mailer: cannot format %T as a date", v)
+	}
+}
+
+func toDuration(v any) (time.Duration, error) {
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case float64:
+		return time.Duration(v), nil
+	case int64:
+		return time.Duration(v), nil
+	case string:
+		return time.ParseDuration(v)
+	default:
+		return 0, fmt.Errorf("mailer: cannot format %T as a duration", v)
+	}
+}
@@ -3,9 +3,13 @@ package mailer
 import (
 	"bytes"
 	"embed"
-	"time"
-
-	"github.com/wneessen/go-mail"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
 
 	ht "html/template"
 	tt "text/template"
@@ -19,83 +23,241 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+// ErrPermanent wraps errors which retrying won't fix, such as a 5xx response from the
+// SMTP server rejecting the recipient. Callers can check for it with errors.Is()
+var ErrPermanent = errors.New("permanent delivery failure")
+
+// ErrUnknownTemplate is returned when there's no template file with the requested name
+var ErrUnknownTemplate = errors.New("unknown template")
+
+// Mailer renders emails from the templates and hands them to a Transport. The templates
+// are parsed once, when the Mailer is created, unless hot-reloading has been enabled
 type Mailer struct {
-	client *mail.Client
-	sender string
+	transport Transport
+	sender    string
+	templates map[string]*templateSet
+
+	// When set, templates are re-parsed from this file system on every send instead of
+	// using the cached copies
+	reloadFS fs.FS
 }
 
-func New(host string, port int, username, password, sender string) (*Mailer, error) {
-	client, err := mail.NewClient(
-		host,
-		mail.WithSMTPAuth(mail.SMTPAuthLogin),
-		mail.WithPort(port),
-		mail.WithUsername(username),
-		mail.WithPassword(password),
-		mail.WithTimeout(5*time.Second),
-	)
+// A templateSet holds both parsed forms of one template file. The text form renders the
+// subject and plain text body, and the html form renders the (escaped) HTML body
+type templateSet struct {
+	text *tt.Template
+	html *ht.Template
+}
+
+// New() parses and validates every embedded template, returning an error if any of them
+// is broken, so that a bad template stops the application starting rather than failing
+// the first time it is used
+func New(transport Transport, sender string) (*Mailer, error) {
+	fsys, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
 
+	templates, err := parseTemplates(fsys)
 	if err != nil {
 		return nil, err
 	}
 
-	// Return a Mailer instance containing the client and sender information
 	mailer := &Mailer{
-		client: client,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
+		templates: templates,
 	}
 
 	return mailer, nil
 }
 
-// Method takes the recipient email address, the name of the file contatining the templates, and any dynamic data
-func (m *Mailer) Send(recipient string, templateFile string, data any) error {
-	// ParseFS() method used from the text/template to parse the required template file frem embedded file system
-	textTmpl, err := tt.New("").ParseFS(templateFS, "templates/"+templateFile)
+// ReloadFrom() makes the Mailer re-read its templates from a directory on disk for every
+// email, so that edits show up without a restart. It's intended for development only.
+// The templates in the directory are validated straight away
+func (m *Mailer) ReloadFrom(dir string) error {
+	fsys := os.DirFS(dir)
+
+	_, err := parseTemplates(fsys)
 	if err != nil {
 		return err
 	}
 
+	m.reloadFS = fsys
+	return nil
+}
+
+// Method takes the recipient email address and locale, the name of the file contatining the templates, and any dynamic data
+func (m *Mailer) Send(recipient, locale, templateFile string, data any) error {
+	msg, err := m.Render(locale, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	msg.From = m.sender
+	msg.To = recipient
+
+	return m.transport.Send(msg)
+}
+
+// Render() executes a template with the given data, returning a Message with the subject
+// and bodies filled in but no sender or recipient
+func (m *Mailer) Render(locale, templateFile string, data any) (*Message, error) {
+	tmpl, err := m.template(MatchLocale(locale), templateFile)
+	if err != nil {
+		return nil, err
+	}
+
 	// Execute the named template "subject", passing in the data and storing the result in a bytes.Buffer variable
 	subject := new(bytes.Buffer)
-	err = textTmpl.ExecuteTemplate(subject, "subject", data)
+	err = tmpl.text.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
-	err = textTmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	err = tmpl.text.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	htmlTmpl, err := ht.New("").ParseFS(templateFS, "templates/"+templateFile)
+	htmlBody := new(bytes.Buffer)
+	err = tmpl.html.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	htmlBody := new(bytes.Buffer)
-	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	msg := &Message{
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}
+
+	return msg, nil
+}
+
+// Templates() returns the names of the available template files (without their locale
+// directory), each mapped to the locales it has been translated into
+func (m *Mailer) Templates() (map[string][]string, error) {
+	var names []string
+
+	if m.reloadFS != nil {
+		var err error
+
+		names, err = fs.Glob(m.reloadFS, "*/*.tmpl")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for name := range m.templates {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	templates := map[string][]string{}
+
+	for _, name := range names {
+		locale, file, ok := strings.Cut(name, "/")
+		if ok {
+			templates[file] = append(templates[file], locale)
+		}
+	}
+
+	return templates, nil
+}
+
+// Close() closes the underlying transport
+func (m *Mailer) Close() error {
+	return m.transport.Close()
+}
+
+// Returns the parsed template for a file in the given locale, from the cache or (when
+// hot-reloading) from disk. Templates are stored as templates/<locale>/<file>, and if a
+// file hasn't been translated into the locale, the DefaultLocale version is used instead
+func (m *Mailer) template(locale, templateFile string) (*templateSet, error) {
+	for _, name := range []string{path.Join(locale, templateFile), path.Join(DefaultLocale, templateFile)} {
+		if m.reloadFS != nil {
+			_, err := fs.Stat(m.reloadFS, name)
+			if err == nil {
+				return parseTemplate(m.reloadFS, name)
+			}
+
+			continue
+		}
+
+		tmpl, ok := m.templates[name]
+		if ok {
+			return tmpl, nil
+		}
+	}
+
+	// A missing template won't appear by retrying, so report it as permanent
+	return nil, fmt.Errorf("%w: %w %q", ErrPermanent, ErrUnknownTemplate, templateFile)
+}
+
+// Parses every .tmpl file in fsys, keyed by its path within fsys (such as
+// "en/user_welcome.tmpl")
+func parseTemplates(fsys fs.FS) (map[string]*templateSet, error) {
+	templates := map[string]*templateSet{}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || path.Ext(name) != ".tmpl" {
+			return nil
+		}
+
+		tmpl, err := parseTemplate(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		templates[name] = tmpl
+		return nil
+	})
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMsg()
+	return templates, nil
+}
+
+// Parses a single template file as both text and HTML, checking that it defines all of the
+// blocks which Send() executes. The formatting functions are bound to the locale named by
+// the file's directory
+func parseTemplate(fsys fs.FS, name string) (*templateSet, error) {
+	locale, _, _ := strings.Cut(name, "/")
 
-	err = msg.To(recipient)
+	text, err := tt.New("").Funcs(textFuncs(locale)).ParseFS(fsys, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = msg.From(m.sender)
+	html, err := ht.New("").Funcs(htmlFuncs(locale)).ParseFS(fsys, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg.Subject(subject.String())
-	msg.SetBodyString(mail.TypeTextPlain, plainBody.String())
-	msg.AddAlternativeString(mail.TypeTextHTML, htmlBody.String())
+	var missing []string
+
+	for _, block := range []string{"subject", "plainBody"} {
+		if text.Lookup(block) == nil {
+			missing = append(missing, block)
+		}
+	}
+
+	if html.Lookup("htmlBody") == nil {
+		missing = append(missing, "htmlBody")
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("mailer: template %q is missing the %s block(s)", name, strings.Join(missing, ", "))
+	}
 
-	// Call the DialAndSend() method on the dialer, passing in the message to send. This
-	// opens a connection to the SMTP server, sends the message, then closes the connection
-	return m.client.DialAndSend(msg)
+	return &templateSet{text: text, html: html}, nil
 }
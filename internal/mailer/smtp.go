@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/wneessen/go-mail"
+)
+
+// The number of times Send() tries to deliver a message, and the delay before the first
+// retry. The delay doubles with each retry, plus up to 50% random jitter
+const (
+	maxAttempts  = 3
+	retryBackoff = 500 * time.Millisecond
+)
+
+// SMTPTransport delivers messages through a pool of SMTP clients. Each client keeps its
+// connection open between messages, so most sends don't need to dial and authenticate again
+type SMTPTransport struct {
+	pool chan *pooledClient
+}
+
+type pooledClient struct {
+	client    *mail.Client
+	connected bool
+}
+
+func NewSMTPTransport(host string, port int, username, password string, poolSize int) (*SMTPTransport, error) {
+	t := &SMTPTransport{
+		pool: make(chan *pooledClient, max(poolSize, 1)),
+	}
+
+	for range cap(t.pool) {
+		client, err := mail.NewClient(
+			host,
+			mail.WithSMTPAuth(mail.SMTPAuthLogin),
+			mail.WithPort(port),
+			mail.WithUsername(username),
+			mail.WithPassword(password),
+			mail.WithTimeout(5*time.Second),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.pool <- &pooledClient{client: client}
+	}
+
+	return t, nil
+}
+
+// Send() delivers the message over a pooled connection, retrying temporary failures with
+// jittered exponential backoff. Permanent failures are returned straight away, wrapped
+// in ErrPermanent
+func (t *SMTPTransport) Send(message *Message) error {
+	msg, err := message.build()
+	if err != nil {
+		return err
+	}
+
+	// Take a client from the pool, waiting for one to be returned if they're all busy
+	pc := <-t.pool
+	defer func() { t.pool <- pc }()
+
+	for attempt := range maxAttempts {
+		if attempt > 0 {
+			backoff := retryBackoff << (attempt - 1)
+			time.Sleep(backoff + rand.N(backoff/2))
+		}
+
+		err = pc.send(msg)
+		if err == nil {
+			return nil
+		}
+
+		if isPermanent(err) {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+	}
+
+	return err
+}
+
+// Close() closes every pooled connection. It waits for any sends in progress to finish
+func (t *SMTPTransport) Close() error {
+	var errs []error
+
+	for range cap(t.pool) {
+		pc := <-t.pool
+
+		if pc.connected {
+			errs = append(errs, pc.client.Close())
+			pc.connected = false
+		}
+
+		defer func() { t.pool <- pc }()
+	}
+
+	return errors.Join(errs...)
+}
+
+// send() delivers a message over the client's open connection, dialling first if there
+// isn't one. A connection the server has since closed is replaced straight away rather
+// than counting as a failed attempt
+func (pc *pooledClient) send(msg *mail.Msg) error {
+	if !pc.connected {
+		err := pc.dial()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := pc.client.Send(msg)
+
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) && sendErr.Reason == mail.ErrConnCheck {
+		pc.connected = false
+
+		err = pc.dial()
+		if err != nil {
+			return err
+		}
+
+		err = pc.client.Send(msg)
+	}
+
+	// After anything other than a server response, the state of the connection is
+	// unknown, so drop it and dial a fresh one next time
+	if err != nil && smtpCode(err) == 0 {
+		pc.client.Close()
+		pc.connected = false
+	}
+
+	return err
+}
+
+func (pc *pooledClient) dial() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := pc.client.DialWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	pc.connected = true
+	return nil
+}
+
+// Returns the SMTP reply code for an error from the server, or 0 if the error didn't
+// come from an SMTP reply (such as a network error)
+func smtpCode(err error) int {
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) {
+		return sendErr.ErrorCode()
+	}
+
+	return 0
+}
+
+// Reports whether a delivery error is permanent. SMTP 5xx replies are permanent and 4xx
+// replies are temporary. Errors without a reply code, like timeouts or dropped
+// connections, are treated as temporary
+func isPermanent(err error) bool {
+	return smtpCode(err) >= 500
+}
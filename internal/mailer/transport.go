@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wneessen/go-mail"
+)
+
+// Transport delivers rendered messages. SMTPTransport sends them for real, while
+// FileTransport and MemoryTransport let the application run without an SMTP server
+type Transport interface {
+	Send(msg *Message) error
+	Close() error
+}
+
+// Message is a rendered email, ready to be delivered
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// build() converts the message to a go-mail message. An invalid recipient address can
+// never be delivered, so it is reported as a permanent failure
+func (m *Message) build() (*mail.Msg, error) {
+	msg := mail.NewMsg()
+
+	err := msg.To(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	err = msg.From(m.From)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Subject(m.Subject)
+	msg.SetBodyString(mail.TypeTextPlain, m.PlainBody)
+	msg.AddAlternativeString(mail.TypeTextHTML, m.HTMLBody)
+
+	return msg, nil
+}
+
+// FileTransport writes each message to its own .eml file in a directory, where it can be
+// opened with any mail client
+type FileTransport struct {
+	dir string
+
+	mu    sync.Mutex
+	count int
+}
+
+// NewFileTransport() returns a FileTransport for the directory, creating it if necessary
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Send(message *Message) error {
+	msg, err := message.build()
+	if err != nil {
+		return err
+	}
+
+	// Number the files as well as timestamping them, so messages sent within the same
+	// instant don't overwrite each other
+	t.mu.Lock()
+	t.count++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405.000000000"), t.count)
+	t.mu.Unlock()
+
+	return msg.WriteToFile(filepath.Join(t.dir, name))
+}
+
+func (t *FileTransport) Close() error {
+	return nil
+}
+
+// MemoryTransport keeps every message it is sent, so that tests can inspect them
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(message *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *message)
+	return nil
+}
+
+// Messages() returns a copy of the messages sent so far, oldest first
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Message(nil), t.messages...)
+}
+
+func (t *MemoryTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,487 @@
+// Package msgpack implements the part of the MessagePack format (https://msgpack.org/) needed
+// to carry JSON-like documents: nil, booleans, integers, floats, strings, binary data, arrays
+// and maps with string keys. Extension types, including timestamps, are not supported
+package msgpack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// maxDepth is how deeply arrays and maps may be nested when decoding, so that a short
+// hostile document can't exhaust the stack
+const maxDepth = 1000
+
+var ErrUnsupported = errors.New("msgpack: unsupported type")
+
+// SyntaxError describes data which isn't valid MessagePack, and the byte offset it was found at
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("msgpack: %s at byte %d", e.msg, e.Offset)
+}
+
+// Encoder writes MessagePack values to an output stream. Each value is written with the
+// smallest representation that holds it
+type Encoder struct {
+	w       io.Writer
+	scratch [9]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode() writes v, which may be nil, a bool, any integer or float type, a string, a []byte,
+// or a []any or map[string]any holding any of these. Map keys are written in sorted order
+func (e *Encoder) Encode(v any) error {
+	switch v := v.(type) {
+	case nil:
+		return e.EncodeNil()
+	case bool:
+		return e.EncodeBool(v)
+	case int:
+		return e.EncodeInt(int64(v))
+	case int8:
+		return e.EncodeInt(int64(v))
+	case int16:
+		return e.EncodeInt(int64(v))
+	case int32:
+		return e.EncodeInt(int64(v))
+	case int64:
+		return e.EncodeInt(v)
+	case uint:
+		return e.EncodeUint(uint64(v))
+	case uint8:
+		return e.EncodeUint(uint64(v))
+	case uint16:
+		return e.EncodeUint(uint64(v))
+	case uint32:
+		return e.EncodeUint(uint64(v))
+	case uint64:
+		return e.EncodeUint(v)
+	case float32:
+		return e.EncodeFloat(float64(v))
+	case float64:
+		return e.EncodeFloat(v)
+	case string:
+		return e.EncodeString(v)
+	case []byte:
+		return e.EncodeBytes(v)
+
+	case []any:
+		err := e.EncodeArrayLen(len(v))
+		if err != nil {
+			return err
+		}
+
+		for _, elem := range v {
+			err = e.Encode(elem)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case map[string]any:
+		err := e.EncodeMapLen(len(v))
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			err = e.EncodeString(key)
+			if err != nil {
+				return err
+			}
+
+			err = e.Encode(v[key])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %T", ErrUnsupported, v)
+}
+
+func (e *Encoder) EncodeNil() error {
+	return e.write(0xc0)
+}
+
+func (e *Encoder) EncodeBool(b bool) error {
+	if b {
+		return e.write(0xc3)
+	}
+
+	return e.write(0xc2)
+}
+
+func (e *Encoder) EncodeInt(i int64) error {
+	switch {
+	case i >= 0:
+		return e.EncodeUint(uint64(i))
+	case i >= -32:
+		return e.write(byte(i))
+	case i >= math.MinInt8:
+		return e.write(0xd0, byte(i))
+	case i >= math.MinInt16:
+		return e.writeUint(0xd1, uint64(uint16(i)), 2)
+	case i >= math.MinInt32:
+		return e.writeUint(0xd2, uint64(uint32(i)), 4)
+	default:
+		return e.writeUint(0xd3, uint64(i), 8)
+	}
+}
+
+func (e *Encoder) EncodeUint(u uint64) error {
+	switch {
+	case u <= 0x7f:
+		return e.write(byte(u))
+	case u <= math.MaxUint8:
+		return e.write(0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return e.writeUint(0xcd, u, 2)
+	case u <= math.MaxUint32:
+		return e.writeUint(0xce, u, 4)
+	default:
+		return e.writeUint(0xcf, u, 8)
+	}
+}
+
+func (e *Encoder) EncodeFloat(f float64) error {
+	return e.writeUint(0xcb, math.Float64bits(f), 8)
+}
+
+func (e *Encoder) EncodeString(s string) error {
+	var err error
+
+	switch n := len(s); {
+	case n < 32:
+		err = e.write(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		err = e.write(0xd9, byte(n))
+	case n <= math.MaxUint16:
+		err = e.writeUint(0xda, uint64(n), 2)
+	default:
+		err = e.writeUint(0xdb, uint64(n), 4)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(e.w, s)
+	return err
+}
+
+func (e *Encoder) EncodeBytes(b []byte) error {
+	var err error
+
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		err = e.write(0xc4, byte(n))
+	case n <= math.MaxUint16:
+		err = e.writeUint(0xc5, uint64(n), 2)
+	default:
+		err = e.writeUint(0xc6, uint64(n), 4)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(b)
+	return err
+}
+
+// EncodeArrayLen() starts an array of n elements, which the caller then encodes in turn
+func (e *Encoder) EncodeArrayLen(n int) error {
+	switch {
+	case n < 16:
+		return e.write(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		return e.writeUint(0xdc, uint64(n), 2)
+	default:
+		return e.writeUint(0xdd, uint64(n), 4)
+	}
+}
+
+// EncodeMapLen() starts a map of n entries, which the caller then encodes in turn as
+// alternating keys and values
+func (e *Encoder) EncodeMapLen(n int) error {
+	switch {
+	case n < 16:
+		return e.write(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		return e.writeUint(0xde, uint64(n), 2)
+	default:
+		return e.writeUint(0xdf, uint64(n), 4)
+	}
+}
+
+func (e *Encoder) write(b ...byte) error {
+	_, err := e.w.Write(b)
+	return err
+}
+
+// writeUint() writes the type byte t followed by the low size bytes of u, big-endian
+func (e *Encoder) writeUint(t byte, u uint64, size int) error {
+	e.scratch[0] = t
+	binary.BigEndian.PutUint64(e.scratch[1:], u<<(64-8*size))
+
+	_, err := e.w.Write(e.scratch[:1+size])
+	return err
+}
+
+// Decoder reads MessagePack values from an input stream
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	depth  int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode() reads the next value from the stream. Integers are returned as int64, or uint64 if
+// too large for an int64, floats as float64, binary data as []byte, arrays as []any and maps
+// as map[string]any. It returns io.EOF if the stream ends cleanly before the value, and
+// io.ErrUnexpectedEOF if it ends part way through
+func (d *Decoder) Decode() (any, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	d.offset++
+
+	v, err := d.decodeValue(t)
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return v, err
+}
+
+func (d *Decoder) decodeValue(t byte) (any, error) {
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.decodeMap(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return d.decodeArray(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.readString(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLen(t - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := d.readN(n)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+
+	case 0xd0:
+		u, err := d.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return int64(u), err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLen(t - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+
+	case 0xdc, 0xdd:
+		n, err := d.readLen(t - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+
+	case 0xde, 0xdf:
+		n, err := d.readLen(t - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return nil, fmt.Errorf("%w: extension type 0x%02x at byte %d", ErrUnsupported, t, d.offset-1)
+	}
+
+	return nil, &SyntaxError{Offset: d.offset - 1, msg: fmt.Sprintf("invalid type byte 0x%02x", t)}
+}
+
+func (d *Decoder) decodeArray(n int) (any, error) {
+	err := d.descend()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	// The length comes from the input, so don't trust it for the initial allocation
+	arr := make([]any, 0, min(n, 64))
+
+	for range n {
+		v, err := d.decodeNext()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+
+	return arr, nil
+}
+
+func (d *Decoder) decodeMap(n int) (any, error) {
+	err := d.descend()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	m := make(map[string]any, min(n, 64))
+
+	for range n {
+		offset := d.offset
+
+		k, err := d.decodeNext()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, &SyntaxError{Offset: offset, msg: "map key is not a string"}
+		}
+
+		m[key], err = d.decodeNext()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (d *Decoder) decodeNext() (any, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	d.offset++
+
+	return d.decodeValue(t)
+}
+
+func (d *Decoder) descend() error {
+	if d.depth >= maxDepth {
+		return &SyntaxError{Offset: d.offset - 1, msg: "exceeded max depth"}
+	}
+
+	d.depth++
+	return nil
+}
+
+// readLen() reads a length of 1 << size bytes
+func (d *Decoder) readLen(size byte) (int, error) {
+	u, err := d.readUint(1 << size)
+	return int(u), err
+}
+
+// readUint() reads an unsigned big-endian integer of size bytes
+func (d *Decoder) readUint(size int) (uint64, error) {
+	var buf [8]byte
+
+	_, err := io.ReadFull(d.r, buf[8-size:])
+	if err != nil {
+		return 0, err
+	}
+	d.offset += int64(size)
+
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (d *Decoder) readString(n int) (any, error) {
+	b, err := d.readN(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// readN() reads n bytes. The buffer grows as the data arrives rather than being allocated up
+// front, so a bogus length can't force a huge allocation
+func (d *Decoder) readN(n int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+	d.offset += int64(len(b))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return b, nil
+}
@@ -0,0 +1,154 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  any // The decoded value, if it differs from value
+	}{
+		{"nil", nil, nil},
+		{"true", true, nil},
+		{"false", false, nil},
+		{"positive fixint", int64(127), nil},
+		{"negative fixint", int64(-32), nil},
+		{"int8", int64(-128), nil},
+		{"int16", int64(-32768), nil},
+		{"int32", int64(math.MinInt32), nil},
+		{"int64", int64(math.MinInt64), nil},
+		{"uint8", int64(255), nil},
+		{"uint16", int64(65535), nil},
+		{"uint32", int64(math.MaxUint32), nil},
+		{"max int64", int64(math.MaxInt64), nil},
+		{"uint64", uint64(math.MaxUint64), nil},
+		{"small int type", int16(300), int64(300)},
+		{"float32", float32(1.5), float64(1.5)},
+		{"float64", math.Pi, nil},
+		{"fixstr", "Moana", nil},
+		{"str8", strings.Repeat("a", 200), nil},
+		{"str16", strings.Repeat("b", 70_000), nil},
+		{"unicode", "Amélie — 天気の子", nil},
+		{"bin", []byte{0, 1, 2, 255}, nil},
+		{"empty array", []any{}, nil},
+		{"array16", make([]any, 20), nil},
+		{"empty map", map[string]any{}, nil},
+		{"nested", map[string]any{
+			"title":   "Moana",
+			"runtime": "107 mins",
+			"genres":  []any{"animation", "adventure"},
+			"meta":    map[string]any{"version": int64(3), "rating": nil},
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := NewEncoder(&buf).Encode(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dec := NewDecoder(&buf)
+
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.value
+			if tt.want != nil {
+				want = tt.want
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %#v; want %#v", got, want)
+			}
+
+			_, err = dec.Decode()
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("got %v after the value; want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestEncodeMapKeysSorted(t *testing.T) {
+	var a, b bytes.Buffer
+
+	value := map[string]any{"c": int64(3), "a": int64(1), "b": int64(2)}
+
+	NewEncoder(&a).Encode(value)
+	NewEncoder(&b).Encode(value)
+
+	want := []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02, 0xa1, 'c', 0x03}
+	if !bytes.Equal(a.Bytes(), want) || !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("got % x and % x; want % x", a.Bytes(), b.Bytes(), want)
+	}
+}
+
+func TestEncodeUnsupported(t *testing.T) {
+	err := NewEncoder(io.Discard).Encode(struct{}{})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got %v; want ErrUnsupported", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		offset int64 // The offset of the SyntaxError, or -1 if another error is expected
+		want   error
+	}{
+		{"empty", nil, -1, io.EOF},
+		{"truncated string", []byte{0xa5, 'M', 'o'}, -1, io.ErrUnexpectedEOF},
+		{"truncated map", []byte{0x82, 0xa1, 'a', 0x01}, -1, io.ErrUnexpectedEOF},
+		{"truncated length", []byte{0xda, 0x01}, -1, io.ErrUnexpectedEOF},
+		{"huge length", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, -1, io.ErrUnexpectedEOF},
+		{"invalid type", []byte{0x91, 0xc1}, 1, nil},
+		{"non-string key", []byte{0x81, 0x01, 0x02}, 1, nil},
+		{"too deep", append(bytes.Repeat([]byte{0x91}, maxDepth+1), 0xc0), maxDepth, nil},
+		{"extension", []byte{0xd4, 0x01, 0x00}, -1, ErrUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(tt.input)).Decode()
+
+			if tt.offset < 0 {
+				if !errors.Is(err, tt.want) {
+					t.Errorf("got %v; want %v", err, tt.want)
+				}
+				return
+			}
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("got %v; want a SyntaxError", err)
+			}
+
+			if syntaxErr.Offset != tt.offset {
+				t.Errorf("got offset %d; want %d", syntaxErr.Offset, tt.offset)
+			}
+		})
+	}
+}
+
+func TestDecodeAtMaxDepth(t *testing.T) {
+	input := append(bytes.Repeat([]byte{0x91}, maxDepth), 0xc0)
+
+	_, err := NewDecoder(bytes.NewReader(input)).Decode()
+	if err != nil {
+		t.Errorf("got %v; want arrays nested %d deep to decode", err, maxDepth)
+	}
+}
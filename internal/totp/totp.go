@@ -0,0 +1,104 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters used by every mainstream authenticator app. They are fixed rather than
+// configurable, since anything else is poorly supported
+const (
+	digits = 6
+	period = 30 * time.Second
+	skew   = 1 // Number of steps either side of the current one that are also accepted
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret() returns a new random 160-bit secret, base32 encoded as expected by
+// authenticator apps
+func GenerateSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return encoding.EncodeToString(secret)
+}
+
+// URI() returns the otpauth:// URI for a secret, which authenticator apps can import
+// directly or from a QR code
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(int(period.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step() returns the time step number for a point in time
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(period.Seconds())
+}
+
+// Code() returns the code for a secret at a specific time step, as defined by RFC 4226
+// (HOTP) with the step number as the counter, which is what RFC 6238 specifies
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low 4 bits of the last byte pick the offset of 4 bytes,
+	// which are read as a 31-bit integer
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1_000_000), nil
+}
+
+// Validate() checks a code against the secret at time t, allowing for a step of clock
+// skew either way. Steps at or before lastStep are rejected so that a code can't be
+// replayed. On success it returns the matched step, which the caller should store as the
+// new lastStep
+func Validate(code, secret string, t time.Time, lastStep int64) (int64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+
+	current := Step(t)
+
+	for step := current - skew; step <= current+skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,192 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes the rules a new password has to follow. Breached is optional,
+// and when it is nil no breached-password check is made
+type PasswordPolicy struct {
+	MinLength  int
+	MaxLength  int
+	MinEntropy float64
+	Breached   *BreachedPasswords
+}
+
+// Validate() checks a password against the policy, reporting every violation on the
+// "password" key. The personal values (such as the user's name and email address) must
+// not appear in the password
+func (p PasswordPolicy) Validate(v *Validator, password string, personal ...string) {
+	var violations []string
+
+	// The code reported is for the length checks if one of them failed, since fixing the
+	// length comes first, and CodeInvalid otherwise
+	code := CodeInvalid
+
+	switch {
+	case password == "":
+		violations = append(violations, "must be provided")
+		code = CodeRequired
+	case len(password) < p.MinLength:
+		violations = append(violations, fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+		code = CodeTooShort
+	case len(password) > p.MaxLength:
+		violations = append(violations, fmt.Sprintf("must not be more than %d bytes long", p.MaxLength))
+		code = CodeTooLong
+	}
+
+	if password != "" && Entropy(password) < p.MinEntropy {
+		violations = append(violations, "is too easy to guess, try a longer password or mix in other kinds of characters")
+	}
+
+	if containsPersonalInfo(password, personal) {
+		violations = append(violations, "must not contain your name or email address")
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, "has appeared in a data breach, please choose a different one")
+	}
+
+	if len(violations) > 0 {
+		v.AddErrorCode("password", code, strings.Join(violations, "; "))
+	}
+}
+
+// Entropy() returns a rough estimate, in bits, of how hard a password is to guess. It is
+// based on the size of the character pool used, and characters which repeat or continue
+// a run from the previous character (like "aaa" or "123") don't count towards the length
+func Entropy(password string) float64 {
+	var (
+		hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+		length                                            int
+		previous                                          rune = -1
+	)
+
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+
+		if r != previous && r != previous+1 && r != previous-1 {
+			length++
+		}
+		previous = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// Reports whether the password contains any of the personal values. Only the local part
+// of an email address is used, values are split into separate words, and anything
+// shorter than 3 characters is ignored
+func containsPersonalInfo(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	for _, value := range personal {
+		value, _, _ = strings.Cut(value, "@")
+
+		for _, part := range strings.FieldsFunc(strings.ToLower(value), isSeparator) {
+			if len(part) >= 3 && strings.Contains(lower, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// BreachedPasswords holds the SHA-1 hashes of known breached passwords, bucketed by the
+// first 5 hex characters in the same way as the k-anonymity range API, so that only the
+// remaining suffixes need comparing on lookup
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+// LoadBreachedPasswords() reads a file with one SHA-1 hash per line, in hex, optionally
+// followed by ":<count>" as in the Pwned Passwords downloads. Blank lines and lines
+// starting with "#" are ignored
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+
+		prefix, suffix := hash[:5], hash[5:]
+
+		if breached.ranges[prefix] == nil {
+			breached.ranges[prefix] = make(map[string]struct{})
+		}
+		breached.ranges[prefix][suffix] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return breached, nil
+}
+
+// Contains() reports whether the password's SHA-1 hash is in the list
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := b.ranges[hash[:5]][hash[5:]]
+	return found
+}
@@ -9,13 +9,35 @@ var (
 	EmailRegEx = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// Machine-readable codes for validation errors, reported to clients alongside each message.
+// Errors added without a code have the code CodeInvalid
+const (
+	CodeInvalid       = "invalid"
+	CodeRequired      = "required"
+	CodeDuplicate     = "duplicate"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeTooFew        = "too_few"
+	CodeTooMany       = "too_many"
+	CodeTooSmall      = "too_small"
+	CodeTooLarge      = "too_large"
+	CodeInvalidType   = "invalid_type"
+	CodeAlreadyExists = "already_exists"
+	CodeExpired       = "expired"
+)
+
+// Validator collects an error message, and the code for it, against each invalid key
 type Validator struct {
 	Errors map[string]string
+	Codes  map[string]string
 }
 
-// New() is a helper which creates a new Validator instance with an empty errors map
+// New() is a helper which creates a new Validator instance with empty errors and codes maps
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{
+		Errors: make(map[string]string),
+		Codes:  make(map[string]string),
+	}
 }
 
 // Valid returns true if the errors map does not contain any entries
@@ -25,15 +47,26 @@ func (v *Validator) Valid() bool {
 
 // AddError() adds an error message to the map (no entry already exists for the given key)
 func (v *Validator) AddError(key, message string) {
+	v.AddErrorCode(key, CodeInvalid, message)
+}
+
+// AddErrorCode() is like AddError(), but records code for the error rather than CodeInvalid
+func (v *Validator) AddErrorCode(key, code, message string) {
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
+		v.Codes[key] = code
 	}
 }
 
 // Check() adds an error message to the map only if a validation check is not "ok"
 func (v *Validator) Check(ok bool, key, message string) {
+	v.CheckCode(ok, key, CodeInvalid, message)
+}
+
+// CheckCode() is like Check(), but records code for the error rather than CodeInvalid
+func (v *Validator) CheckCode(ok bool, key, code, message string) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddErrorCode(key, code, message)
 	}
 }
 
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movies_user_id_idx;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS user_id;
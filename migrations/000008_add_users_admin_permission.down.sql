@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_created_at_idx;
+
+DELETE FROM permissions WHERE code = 'users:admin';
@@ -0,0 +1,5 @@
+INSERT INTO permissions (code)
+VALUES
+  ('users:admin');
+
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
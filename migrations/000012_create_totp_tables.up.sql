@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS totp_secrets (
+  user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  secret text NOT NULL,
+  enabled bool NOT NULL DEFAULT false,
+  last_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  hash bytea PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
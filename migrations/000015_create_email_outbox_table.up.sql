@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS email_outbox (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  template text NOT NULL,
+  recipient citext NOT NULL,
+  status text NOT NULL DEFAULT 'queued',
+  attempts integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  sent_at timestamp(0) with time zone
+);
+
+ALTER TABLE email_outbox ADD CONSTRAINT email_outbox_status_check CHECK (status IN ('queued', 'sent', 'failed'));
+
+CREATE INDEX IF NOT EXISTS email_outbox_recipient_idx ON email_outbox (recipient, created_at);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  url text NOT NULL,
+  secret text NOT NULL,
+  events text[] NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+  event text NOT NULL,
+  payload jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  response_status integer,
+  last_error text NOT NULL DEFAULT '',
+  delivered_at timestamp(0) with time zone
+);
+
+ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_status_check CHECK (status IN ('pending', 'delivered', 'failed'));
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS events (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  type text NOT NULL,
+  entity_id bigint NOT NULL,
+  payload jsonb NOT NULL
+);
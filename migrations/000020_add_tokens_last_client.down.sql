@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_user_agent;